@@ -3,6 +3,7 @@ module github.com/progrhyme/shelp
 go 1.14
 
 require (
+	github.com/go-git/go-git/v5 v5.1.0
 	github.com/mattn/go-isatty v0.0.12
 	github.com/spf13/pflag v1.0.5
 	gopkg.in/yaml.v2 v2.3.0
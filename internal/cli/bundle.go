@@ -1,21 +1,44 @@
 package cli
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
 	"text/template"
 
+	"github.com/progrhyme/shelp/internal/config"
 	"github.com/progrhyme/shelp/internal/git"
 )
 
 type bundleCmd struct {
 	gitCmd
+	frozen  *bool
+	stash   *bool
+	force   *bool
+	jobsOpt *int
 }
 
-func newBundleCmd(common commonCmd, git git.Git) bundleCmd {
+// bundleTask is a package to install by bundle
+type bundleTask struct {
+	name string
+	from string
+	at   string
+	args installArgs
+}
+
+func newBundleCmd(common commonCmd, git git.Backend) bundleCmd {
 	cmd := &bundleCmd{}
 	cmd.commonCmd = common
 	cmd.git = git
 	setupCmdFlags(cmd, "bundle", cmd.usage)
+	setupOutputFlag(cmd)
+	cmd.frozen = cmd.flags.Bool("frozen", false, "# Install exact commits in lock file")
+	cmd.stash = cmd.flags.Bool("stash", false, "# Re-install packages keeping local changes aside")
+	cmd.force = cmd.flags.Bool("force", false, "# Re-install packages even if they have local changes")
+	cmd.jobsOpt = cmd.flags.IntP("jobs", "j", 0, "# Number of packages to install in parallel")
 	return *cmd
 }
 
@@ -24,7 +47,7 @@ func (cmd *bundleCmd) usage() {
   Install packages at once which are defined in config file.
 
 Syntax:
-  {{.Prog}} {{.Cmd}} [-c|--config CONFIG]
+  {{.Prog}} {{.Cmd}} [-c|--config CONFIG] [--frozen] [--stash|--force] [-j|--jobs N] [--dry-run]
 
 Options:
 `
@@ -37,7 +60,27 @@ Specification:
   If there are pseudo-installed packages created by "link" command whose names are the same as
   configured packages, "bundle" operation removes the package at first, then re-install it according
   to the configuration.
-`)
+
+  Packages are installed into a new generation, which is switched to when the installation succeeds.
+  See "generations" command.
+
+  Packages are installed in parallel by "-j|--jobs" option or "git.jobs" in config file.
+  Outputs of each package are shown when its installation finishes.
+
+  Packages to re-install which have local changes, i.e. modified or untracked files or commits not
+  pushed to remote, are skipped unless "--force" option is specified. With "--stash" option,
+  packages having only local modifications are re-installed, and the modifications are left in the
+  previous generation.
+
+  Packages listed in "depends" of a package, or in "depends" of "shelp.yml" manifest in the package,
+  are installed before it. They can be specified by package name or by location like "from".
+
+Lock File:
+  "bundle" writes "%s" next to the config file which records resolved URL, ref and commit
+  hash of each package, and of dependencies which are not configured. With "--frozen" option, it
+  installs exactly the commits recorded in the lock file instead, and fails if the config file and
+  the lock file disagree.
+`, config.LockFileName)
 }
 
 func (cmd *bundleCmd) parseAndExec(args []string) error {
@@ -46,53 +89,420 @@ func (cmd *bundleCmd) parseAndExec(args []string) error {
 		return err
 	}
 
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var records []packageRecord
+	bundle := func() (e error) {
+		records, e = cmd.bundle()
+		return e
+	}
+	if isJSONOutput(cmd) {
+		out := cmd.divertOuts()
+		err = inGeneration(cmd, "bundle", bundle)
+		return printJSONResult(cmd, out, records, err)
+	}
+	return inGeneration(cmd, "bundle", bundle)
+}
+
+// bundle installs configured packages and returns records of the results
+func (cmd *bundleCmd) bundle() ([]packageRecord, error) {
+	records := []packageRecord{}
 	if len(cmd.config.Packages) == 0 {
 		fmt.Fprintln(cmd.errs, "No package is configured")
 		cmd.flags.Usage()
-		return ErrCanceled
+		return records, ErrCanceled
 	}
 
-	if err = prepareInstallDirectories(cmd.config); err != nil {
-		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
-		return ErrOperationFailed
+	if !isDryRun(cmd) {
+		if err := prepareInstallDirectories(cmd.config); err != nil {
+			fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+			return records, ErrOperationFailed
+		}
 	}
 
 	var (
-		success  int
-		hasError bool
+		lock config.Lock
+		err  error
 	)
+	if *cmd.frozen {
+		if lock, err = cmd.loadFrozenLock(); err != nil {
+			return records, err
+		}
+	} else {
+		// Previous lock is used for packages failing to install
+		lock, _ = config.LoadLock(cmd.config.LockFile())
+	}
+
+	session := newInstallSession()
+	if *cmd.frozen {
+		session.frozen = &lock
+	}
+
+	var hasError bool
+	tasks := []bundleTask{}
 	for _, param := range cmd.config.Packages {
 		if param.From == "" {
 			fmt.Fprintf(cmd.errs, "Warning! \"from\" is not specified. Skips. pkg = %+v\n", param)
 			hasError = true
+			continue
 		}
 
-		// Install one
-		pkg := installArgs{
-			from:      param.From,
-			as:        param.As,
-			at:        param.At,
-			bin:       param.Bin,
-			overwrite: true,
+		task := bundleTask{
+			from: param.From,
+			at:   param.At,
+			args: installArgs{
+				from:      param.From,
+				as:        param.As,
+				at:        param.At,
+				bin:       param.Bin,
+				depends:   param.Depends,
+				overwrite: true,
+				strategy:  cmd.strategy(),
+				mode:      modeBundle,
+				session:   session,
+			},
+		}
+		spec, err := packageToInstall(cmd, task.args)
+		if err != nil {
+			hasError = true
+			continue
+		}
+		task.name = spec.name
+		if *cmd.frozen {
+			locked, _ := lock.Find(spec.name)
+			task.args.commit = locked.Commit
 		}
-		err = installPackage(cmd, pkg)
-		switch err {
+		tasks = append(tasks, task)
+	}
+	if *cmd.frozen {
+		tasks = append(tasks, cmd.lockedDependencyTasks(lock, session)...)
+	}
+
+	results, err := cmd.installInOrder(tasks)
+	if err != nil {
+		return records, err
+	}
+	if interrupted(cmd) {
+		// Neither summary nor lock file is written for partial result
+		return records, ErrInterrupted
+	}
+
+	var (
+		success int
+		newLock config.Lock
+	)
+	for i, task := range tasks {
+		record := recordOf(cmd, task.name, bundleStatus(results[i]))
+		if record.Status == statusFailed {
+			record.Error = results[i].Error()
+		}
+		records = append(records, record)
+
+		installed := false
+		switch results[i] {
 		case nil, ErrAlreadyInstalled:
 			success++
+			installed = true
+		case ErrWarning:
+			installed = true
+			hasError = true
 		default:
 			hasError = true
 		}
+
+		if *cmd.frozen || isDryRun(cmd) {
+			continue
+		}
+		if installed {
+			if locked, ok := lockPackage(cmd, task.from, task.at, task.name); ok {
+				newLock.Packages = append(newLock.Packages, locked)
+			}
+		} else if locked, ok := lock.Find(task.name); ok {
+			// Keep previous state of the package which failed to install or is skipped
+			if locked.From == task.from && locked.At == task.at {
+				newLock.Packages = append(newLock.Packages, locked)
+			}
+		}
+	}
+	if !*cmd.frozen && !isDryRun(cmd) {
+		newLock.Packages = append(newLock.Packages, cmd.lockDependencies(tasks)...)
+	}
+	if !isJSONOutput(cmd) && !isDryRun(cmd) {
+		cmd.printSummary(records)
+	}
+
+	if !*cmd.frozen && len(newLock.Packages) > 0 {
+		if err = newLock.Save(cmd.config.LockFile()); err != nil {
+			fmt.Fprintf(cmd.errs, "Error! Writing lock file failed. Error = %v\n", err)
+			hasError = true
+		}
 	}
 
 	if hasError {
 		if success > 0 {
 			fmt.Fprintln(cmd.errs, "There are some errors")
-			return ErrWarning
+			return records, ErrWarning
 		} else {
 			fmt.Fprintln(cmd.errs, "Bundle failed")
-			return ErrOperationFailed
+			return records, ErrOperationFailed
+		}
+	}
+
+	return records, nil
+}
+
+// strategy returns how to deal with local changes of packages
+func (cmd *bundleCmd) strategy() string {
+	switch {
+	case *cmd.force:
+		return forceLocal
+	case *cmd.stash:
+		return stashLocal
+	default:
+		return keepLocal
+	}
+}
+
+// installInOrder installs packages so that ones depended on by others in config file go first
+func (cmd *bundleCmd) installInOrder(tasks []bundleTask) ([]error, error) {
+	names := []string{}
+	index := make(map[string]int)
+	depends := make(map[string][]string)
+	for i, task := range tasks {
+		names = append(names, task.name)
+		index[task.name] = i
+		depends[task.name] = dependencyNames(cmd, task.args.depends)
+	}
+	groups, err := sortByDependency(names, depends)
+	if err != nil {
+		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+		return nil, ErrConfig
+	}
+
+	results := make([]error, len(tasks))
+	for _, group := range groups {
+		subset := []bundleTask{}
+		for _, name := range group {
+			subset = append(subset, tasks[index[name]])
+		}
+		for i, err := range cmd.installAll(subset) {
+			results[index[group[i]]] = err
 		}
 	}
+	return results, nil
+}
+
+// installAll installs packages by worker pool of "jobs" size and returns results in order of tasks
+func (cmd *bundleCmd) installAll(tasks []bundleTask) []error {
+	results := make([]error, len(tasks))
+	jobs := cmd.jobs()
+	if jobs <= 1 {
+		for i, task := range tasks {
+			results[i] = installPackage(cmd, task.args)
+		}
+		return results
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	queue := make(chan int)
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				// Buffer outputs not to mix up with ones of other packages
+				outs, errs := &bytes.Buffer{}, &bytes.Buffer{}
+				results[i] = installPackage(cmd.worker(outs, errs), tasks[i].args)
+
+				mutex.Lock()
+				io.Copy(cmd.errs, errs)
+				io.Copy(cmd.outs, outs)
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range tasks {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	return results
+}
+
+func (cmd *bundleCmd) jobs() int {
+	if *cmd.jobsOpt > 0 {
+		return *cmd.jobsOpt
+	}
+	return cmd.config.Git.Jobs
+}
 
-	return nil
+// worker returns a copy of bundleCmd which writes outputs into given writers
+func (cmd *bundleCmd) worker(outs, errs io.Writer) *bundleCmd {
+	w := *cmd
+	w.outs = outs
+	w.errs = errs
+	w.git = cmd.git.WithOutput(outs, errs)
+	return &w
+}
+
+func (cmd *bundleCmd) printSummary(records []packageRecord) {
+	width := 0
+	for _, record := range records {
+		if len(record.Name) > width {
+			width = len(record.Name)
+		}
+	}
+
+	fmt.Fprintln(cmd.outs, "Summary:")
+	for _, record := range records {
+		fmt.Fprintf(cmd.outs, "  %-*s  %s\n", width, record.Name, record.Status)
+	}
+}
+
+func bundleStatus(err error) string {
+	switch err {
+	case nil:
+		return statusInstalled
+	case ErrAlreadyInstalled:
+		return statusUpToDate
+	case ErrWarning:
+		return statusWarning
+	case ErrLocalChanges:
+		return statusSkipped
+	default:
+		return statusFailed
+	}
+}
+
+// loadFrozenLock loads lock file and verifies it agrees with config file
+func (cmd *bundleCmd) loadFrozenLock() (config.Lock, error) {
+	path := cmd.config.LockFile()
+	lock, err := config.LoadLock(path)
+	if err != nil {
+		fmt.Fprintf(cmd.errs, "Error! Can't load lock file: %s. Error = %v\n", path, err)
+		return lock, ErrConfig
+	}
+
+	disagree := false
+	configured := make(map[string]bool)
+	for _, param := range cmd.config.Packages {
+		spec, err := packageToInstall(cmd, installArgs{from: param.From, as: param.As, at: param.At})
+		if err != nil {
+			return lock, err
+		}
+		configured[spec.name] = true
+		locked, ok := lock.Find(spec.name)
+		if !ok {
+			fmt.Fprintf(cmd.errs, "Error! \"%s\" is not found in lock file\n", spec.name)
+			disagree = true
+			continue
+		}
+		if locked.From != param.From || locked.At != param.At || locked.Commit == "" {
+			fmt.Fprintf(cmd.errs, "Error! \"%s\" in config file and lock file disagree\n", spec.name)
+			disagree = true
+		}
+	}
+	for _, locked := range lock.Packages {
+		if !configured[locked.Name] && !locked.Dependency {
+			fmt.Fprintf(cmd.errs, "Error! \"%s\" in lock file is not configured\n", locked.Name)
+			disagree = true
+		}
+	}
+
+	if disagree {
+		fmt.Fprintf(cmd.errs, "Run \"%s bundle\" without \"--frozen\" to update lock file\n", cmd.name)
+		return lock, ErrConfig
+	}
+	return lock, nil
+}
+
+// lockPackage resolves installed state of a package to record in lock file
+func lockPackage(cmd gitRunner, from, at, name string) (config.LockedPackage, bool) {
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	if isLinkedPackage(cmd, name) {
+		return config.LockedPackage{}, false
+	}
+	pkg, err := packageInstalled(cmd, path)
+	if err != nil || pkg.commit == "" {
+		return config.LockedPackage{}, false
+	}
+	return config.LockedPackage{
+		Name: name, From: from, At: at, URL: pkg.url, Ref: pkg.ref, Commit: pkg.commit,
+	}, true
+}
+
+// lockedDependencyTasks returns tasks to install dependencies in lock file at locked commits
+func (cmd *bundleCmd) lockedDependencyTasks(lock config.Lock, session *installSession) []bundleTask {
+	tasks := []bundleTask{}
+	for _, locked := range lock.Packages {
+		if !locked.Dependency {
+			continue
+		}
+		if _, ok := configuredArgs(cmd, locked.Name); ok {
+			continue
+		}
+		tasks = append(tasks, bundleTask{
+			name: locked.Name,
+			from: locked.From,
+			args: installArgs{
+				from:      locked.From,
+				commit:    locked.Commit,
+				overwrite: true,
+				strategy:  cmd.strategy(),
+				mode:      modeDependency,
+				session:   session,
+			},
+		})
+	}
+	return tasks
+}
+
+// lockDependencies resolves installed states of dependencies of bundled packages which are not
+// configured, to record in lock file. Dependencies are found by receipts of installed packages
+func (cmd *bundleCmd) lockDependencies(tasks []bundleTask) []config.LockedPackage {
+	visited := make(map[string]bool)
+	queue := []string{}
+	for _, task := range tasks {
+		visited[task.name] = true
+		queue = append(queue, task.name)
+	}
+
+	names := []string{}
+	for len(queue) > 0 {
+		rc, ok := loadReceipt(cmd.config, queue[0])
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+		for _, dep := range rc.Depends {
+			if !visited[dep] {
+				visited[dep] = true
+				queue = append(queue, dep)
+				names = append(names, dep)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	locked := []config.LockedPackage{}
+	for _, name := range names {
+		rc, ok := loadReceipt(cmd.config, name)
+		if !ok || rc.Mode != modeDependency {
+			// Specified by name, and installed by user
+			continue
+		}
+		if pkg, ok := lockPackage(cmd, rc.From, rc.At, name); ok {
+			pkg.Dependency = true
+			locked = append(locked, pkg)
+		}
+	}
+	return locked
 }
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -24,25 +25,34 @@ var (
 	ErrNoPackage        = errors.New("No package is installed")
 	ErrCanceled         = errors.New("Operation is canceled")
 	ErrWarning          = errors.New("Warning")
+	ErrLocalChanges     = errors.New("Package has local changes")
+	ErrLocked           = errors.New("Another process holds the lock")
+	ErrInterrupted      = errors.New("Interrupted by signal")
 )
 
 type Cli struct {
 	version   string
 	config    *config.Config
-	git       git.Git
+	git       git.Backend
 	outWriter io.Writer
 	errWriter io.Writer
+	ctx       context.Context
 }
 
-func NewCli(ver string, cfg *config.Config, g git.Git, out, err io.Writer) Cli {
-	return Cli{version: ver, config: cfg, git: g, outWriter: out, errWriter: err}
+func NewCli(ver string, cfg *config.Config, g git.Backend, out, err io.Writer) Cli {
+	return Cli{
+		version: ver, config: cfg, git: g, outWriter: out, errWriter: err, ctx: context.Background(),
+	}
 }
 
 func (c *Cli) ParseAndExec(args []string) error {
 	prog := filepath.Base(args[0])
 
-	common := commonCmd{config: c.config, outs: c.outWriter, errs: c.errWriter, name: prog}
+	common := commonCmd{
+		config: c.config, outs: c.outWriter, errs: c.errWriter, name: prog, ctx: c.ctx,
+	}
 	root := newRootCmd(common, c.version)
+	g := c.git.WithContext(c.ctx)
 
 	if len(args) == 1 {
 		root.flags.Usage()
@@ -54,29 +64,47 @@ func (c *Cli) ParseAndExec(args []string) error {
 		initializer := newInitCmd(common)
 		return initializer.parseAndExec(args[2:])
 	case "install", "add":
-		installer := newInstallCmd(common, c.git)
+		installer := newInstallCmd(common, g)
 		return installer.parseAndExec(args[1:])
 	case "list":
-		lister := newListCmd(common)
+		lister := newListCmd(common, g)
 		return lister.parseAndExec(args[2:])
 	case "remove", "uninstall":
 		remover := newRemoveCmd(common)
 		return remover.parseAndExec(args[1:])
 	case "upgrade":
-		upgrader := newUpgradeCmd(common, c.git)
+		upgrader := newUpgradeCmd(common, g)
 		return upgrader.parseAndExec(args[2:])
+	case "generations":
+		lister := newGenerationsCmd(common)
+		return lister.parseAndExec(args[2:])
+	case "rollback":
+		roller := newRollbackCmd(common, g)
+		return roller.parseAndExec(args[2:])
+	case "info":
+		informer := newInfoCmd(common, g)
+		return informer.parseAndExec(args[2:])
 	case "outdated":
-		lister := newOutdatedCmd(common, c.git)
+		lister := newOutdatedCmd(common, g)
 		return lister.parseAndExec(args[2:])
+	case "status":
+		checker := newStatusCmd(common, g)
+		return checker.parseAndExec(args[2:])
 	case "link":
 		linker := newLinkCmd(common)
 		return linker.parseAndExec(args[2:])
 	case "bundle":
-		bundler := newBundleCmd(common, c.git)
+		bundler := newBundleCmd(common, g)
 		return bundler.parseAndExec(args[2:])
+	case "sync":
+		syncer := newSyncCmd(common, g)
+		return syncer.parseAndExec(args[2:])
 	case "prune":
 		pruner := newPruneCmd(common)
 		return pruner.parseAndExec(args[2:])
+	case "compile":
+		compiler := newCompileCmd(common)
+		return compiler.parseAndExec(args[2:])
 	case "destroy":
 		destroyer := newDestroyCmd(common)
 		return destroyer.parseAndExec(args[2:])
@@ -100,6 +128,8 @@ func setupCmdFlags(cmd interface{}, name string, usage func()) {
 		option.setConfig(flags.StringP("config", "c", "", "# Configuration file"))
 		option.setHelp(flags.BoolP("help", "h", false, "# Show help"))
 		option.setVerbose(flags.BoolP("verbose", "v", false, "# Verbose output"))
+		option.setDryRun(flags.Bool("dry-run", false, "# Report operations without doing them"))
+		option.setWait(flags.Duration("wait", 0, "# Time to wait for another running shelp; e.g. 30s"))
 
 	case helpRunner:
 		option := cmd.(helpRunner).getOpts()
@@ -111,6 +141,11 @@ func setupCmdFlags(cmd interface{}, name string, usage func()) {
 	}
 }
 
+// setupOutputFlag adds "--output" option to a command which supports machine-readable output
+func setupOutputFlag(cmd helpRunner) {
+	cmd.getOpts().setOutput(cmd.getFlags().String("output", outputText, "# Output format: text|json"))
+}
+
 // Start parsing command-line arguments
 // Then, load configuration file if it exists
 func parseStart(cmd helpRunner, args []string, requireArg, silent bool) (done bool, e error) {
@@ -135,6 +170,18 @@ func parseStart(cmd helpRunner, args []string, requireArg, silent bool) (done bo
 		return true, ErrUsage
 	}
 
+	// Only commands set up by setupOutputFlag have "--output" option
+	if output := cmd.getOpts().getOutput(); output != nil {
+		switch *output {
+		case outputText, outputJSON:
+			// OK
+		default:
+			fmt.Fprintf(cmd.getErrs(), "Error! Unknown output format: %s\n", *output)
+			cmd.getFlags().Usage()
+			return true, ErrParseFailed
+		}
+	}
+
 	// Load config file
 	if err := cmd.getConfig().LoadConfig(*cmd.getOpts().getConfig()); err != nil {
 		return true, ErrConfig
@@ -143,9 +190,36 @@ func parseStart(cmd helpRunner, args []string, requireArg, silent bool) (done bo
 		fmt.Fprintf(cmd.getErrs(), "Use config: %s\n", cmd.getConfig().File())
 	}
 
+	if gr, ok := cmd.(gitRunner); ok {
+		// Switch git backend if configured
+		backend := gr.getGit()
+		cfg := cmd.getConfig()
+		if cfg.Git.Backend != "" {
+			var err error
+			backend, err = git.NewBackend(cfg.Git.Backend, cmd.getOuts(), cmd.getErrs())
+			if err != nil {
+				fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+				return true, ErrConfig
+			}
+		}
+		policy := git.Policy{Timeout: cfg.Git.Timeout, Retries: cfg.Git.Retries}
+		backend = git.WithPolicy(backend, policy, cmd.getErrs())
+		gr.setGit(backend.WithContext(cmd.getContext()))
+	}
+
 	return false, nil
 }
 
+// isDryRun tells whether the command should only report what it would do
+func isDryRun(cmd verboseRunner) bool {
+	return *cmd.getVerboseOpts().getDryRun()
+}
+
+// wouldDo reports an operation skipped in dry-run mode
+func wouldDo(cmd runner, format string, a ...interface{}) {
+	fmt.Fprintf(cmd.getOuts(), "Would "+format+"\n", a...)
+}
+
 func installedPackages(cmd runner, noPkgErr bool) ([]os.FileInfo, error) {
 	var pkgs []os.FileInfo
 	nopkg := func() ([]os.FileInfo, error) {
@@ -68,6 +68,14 @@ Syntax:`,
 		`Summary:
   List installed packages.
 
+Syntax:`,
+	}
+
+	commands["info"] = command{
+		true,
+		`Summary:
+  Show details of an installed package.
+
 Syntax:`,
 	}
 
@@ -84,6 +92,23 @@ Syntax:`,
 		`Summary:
   Show installed packages which can be updated.
 
+Syntax:`,
+	}
+
+	commands["status"] = command{
+		true,
+		`Summary:
+  Show installed packages which have local changes.
+
+Syntax:`,
+	}
+
+	commands["rollback"] = command{
+		true,
+		`Summary:
+  Roll back a package to the commit installed before its upgrade or re-install.
+  Or switch all packages back to a generation.
+
 Syntax:`,
 	}
 
@@ -96,6 +121,12 @@ Syntax:`,
 Syntax:`,
 	}
 
+	commands["compile"] = command{
+		true,
+		`Summary:
+  Make a standalone shell script which runs without shelp.`,
+	}
+
 	commands["destroy"] = command{
 		false,
 		fmt.Sprintf(`Summary:
@@ -117,20 +148,45 @@ Syntax:`,
 		`Summary:
   Uninstall packages not defined in config file.
 
+Syntax:`,
+	}
+
+	commands["sync"] = command{
+		false,
+		`Summary:
+  Make installed packages match config file at once.
+
 Syntax:`,
 	}
 
 	initTextSh := fmt.Sprintf(`export %s="%s"
 PATH="%s:${PATH}"
 
-# Load script in a package`, config.RootVarName, cfg.RootPath(), cfg.BinPath())
+# Load script in a package`, config.RootVarName, cfg.RootPath(), cfg.ShellBinPath())
 
 	initTextFish := fmt.Sprintf(`set -gx %s %s
 if not contains %s $PATH
   set -gx PATH %s $PATH
 end
 
-# Load script in a package`, config.RootVarName, cfg.RootPath(), cfg.BinPath(), cfg.BinPath())
+# Load script in a package`, config.RootVarName, cfg.RootPath(), cfg.ShellBinPath(), cfg.ShellBinPath())
+
+	initTextOthers := map[string]string{
+		"tcsh": fmt.Sprintf("setenv %s \"%s\";\nsetenv PATH \"%s:${PATH}\";\nalias include",
+			config.RootVarName, cfg.RootPath(), cfg.ShellBinPath()),
+		"pwsh": fmt.Sprintf("$env:%s = '%s'\nif (($env:PATH -split [IO.Path]::PathSeparator)",
+			config.RootVarName, cfg.RootPath()),
+		"nu": fmt.Sprintf("$env.%s = '%s'\n$env.PATH = ($env.PATH | split row (char esep)",
+			config.RootVarName, cfg.RootPath()),
+		"elvish": fmt.Sprintf("use path\nuse str\nset-env %s '%s'\nset paths = ['%s'",
+			config.RootVarName, cfg.RootPath(), cfg.ShellBinPath()),
+		"xonsh": fmt.Sprintf("$%s = '%s'\nif '%s' not in $PATH:\n    $PATH.insert(0, '%s')",
+			config.RootVarName, cfg.RootPath(), cfg.ShellBinPath(), cfg.ShellBinPath()),
+	}
+
+	initShareZsh := fmt.Sprintf(`fpath=("%s/zsh/site-functions" $fpath)`, cfg.ShellSharePath())
+	initShareFish := fmt.Sprintf(`if not contains %s/fish/vendor_completions.d $fish_complete_path`,
+		cfg.ShellSharePath())
 
 	// Test cases
 	tests := []struct {
@@ -171,6 +227,13 @@ end
 		},
 		{[]string{prog, "init", "-"}, nil, initTextSh, ""},
 		{[]string{prog, "init", "-", "fish"}, nil, initTextFish, ""},
+		{[]string{prog, "init", "-", "zsh"}, nil, initShareZsh, ""},
+		{[]string{prog, "init", "-", "fish"}, nil, initShareFish, ""},
+		{[]string{prog, "init", "-", "tcsh"}, nil, initTextOthers["tcsh"], ""},
+		{[]string{prog, "init", "-", "pwsh"}, nil, initTextOthers["pwsh"], ""},
+		{[]string{prog, "init", "-", "nu"}, nil, initTextOthers["nu"], ""},
+		{[]string{prog, "init", "-", "elvish"}, nil, initTextOthers["elvish"], ""},
+		{[]string{prog, "init", "-", "xonsh"}, nil, initTextOthers["xonsh"], ""},
 
 		// Subcommand "install"
 		{
@@ -247,6 +310,32 @@ end
 			strings.Join([]string{flagError, commands["outdated"].helpText}, "\n"),
 		},
 
+		// Subcommand "status"
+		{
+			[]string{prog, "status"},
+			ErrNoPackage, "", "No package is installed",
+		},
+		{
+			[]string{prog, "status", "--help"},
+			nil, "", commands["status"].helpText,
+		},
+		{
+			[]string{prog, "status", "--no-such-option"},
+			ErrParseFailed, "",
+			strings.Join([]string{flagError, commands["status"].helpText}, "\n"),
+		},
+
+		// Subcommand "rollback"
+		{
+			[]string{prog, "rollback"},
+			ErrUsage, "", commands["rollback"].helpText,
+		},
+		{
+			[]string{prog, "rollback", "not-installed-package"},
+			ErrArgument, "",
+			"\"not-installed-package\" is not installed",
+		},
+
 		// Subcommand "list"
 		{
 			[]string{prog, "list"},
@@ -262,6 +351,41 @@ end
 			strings.Join([]string{flagError, commands["list"].helpText}, "\n"),
 		},
 
+		// Subcommand "info"
+		{
+			[]string{prog, "info"},
+			ErrUsage, "", commands["info"].helpText,
+		},
+		{
+			[]string{prog, "info", "--help"},
+			nil, "", commands["info"].helpText,
+		},
+		{
+			[]string{prog, "info", "--no-such-option"},
+			ErrParseFailed, "",
+			strings.Join([]string{flagError, commands["info"].helpText}, "\n"),
+		},
+		{
+			[]string{prog, "info", "not-installed-package"},
+			ErrArgument, "",
+			"\"not-installed-package\" is not installed",
+		},
+
+		{
+			[]string{prog, "list", "--output", "yaml"},
+			ErrParseFailed, "",
+			strings.Join([]string{"Error! Unknown output format: yaml", commands["list"].helpText}, "\n"),
+		},
+		{
+			[]string{prog, "list", "--output", "json"},
+			nil, `"result": "ok"`, "No package is installed",
+		},
+		{
+			[]string{prog, "install", "--output", "json", validPkgRepo},
+			ErrParseFailed, "",
+			strings.Join([]string{"Error! unknown flag: --output", commands["install"].helpText}, "\n"),
+		},
+
 		// Subcommand "link"
 		{
 			[]string{prog, "link"},
@@ -287,6 +411,21 @@ end
 			"Error! Given argument \"-\" does not look like valid package name\n",
 		},
 
+		// Subcommand "compile"
+		{
+			[]string{prog, "compile"},
+			ErrUsage, "", commands["compile"].helpText,
+		},
+		{
+			[]string{prog, "compile", "--help"},
+			nil, "", commands["compile"].helpText,
+		},
+		{
+			[]string{prog, "compile", "--no-such-option"},
+			ErrParseFailed, "",
+			strings.Join([]string{flagError, commands["compile"].helpText}, "\n"),
+		},
+
 		// Subcommand "destroy"
 		{
 			[]string{prog, "destroy"},
@@ -318,6 +457,22 @@ end
 			strings.Join([]string{flagError, commands["bundle"].helpText}, "\n"),
 		},
 
+		// Subcommand "sync"
+		{
+			[]string{prog, "sync"},
+			ErrCanceled, "",
+			strings.Join([]string{"No package is configured", commands["sync"].helpText}, "\n"),
+		},
+		{
+			[]string{prog, "sync", "--help"},
+			nil, "", commands["sync"].helpText,
+		},
+		{
+			[]string{prog, "sync", "--no-such-option"},
+			ErrParseFailed, "",
+			strings.Join([]string{flagError, commands["sync"].helpText}, "\n"),
+		},
+
 		// Subcommand "prune"
 		{
 			[]string{prog, "prune"},
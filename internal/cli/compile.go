@@ -0,0 +1,281 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// includeStatement matches "include <package> <file>" whose arguments are literal words
+var includeStatement = regexp.MustCompile(
+	`^(\s*)include\s+(` + literalWord + `)\s+(` + literalWord + `)\s*(?:#.*)?$`)
+
+// literalWord is a word of shell which has no expansion
+const literalWord = `'[^']+'|"[^"$\x60\\]+"|[^\s'"$\x60\\;&|#<>()]+`
+
+// includeLike matches lines which look like calling "include"
+var includeLike = regexp.MustCompile(`^\s*include\s`)
+
+// scriptPathLike matches references to path of running script, which is not the included file in
+// compiled script
+var scriptPathLike = regexp.MustCompile(`BASH_SOURCE|\$\{?0\b`)
+
+// functionStart and blockEnd match lines which open and close definition of function in common
+// style. They tell whether "return" is at top level of a file
+var (
+	functionStart = regexp.MustCompile(
+		`^\s*(?:function\s+)?[\w.:-]+\s*(?:\(\s*\))?\s*\{\s*(?:#.*)?$`)
+	blockEnd = regexp.MustCompile(`^\s*\}\s*(?:#.*)?$`)
+)
+
+// returnLike matches lines which look like calling "return"
+var returnLike = regexp.MustCompile(`(?:^|[\s;&|(])return(?:\s|;|$)`)
+
+// nonWordChars matches characters which can't be used in names of variables
+var nonWordChars = regexp.MustCompile(`\W`)
+
+type compileCmd struct {
+	verboseCmd
+	out *string
+}
+
+func newCompileCmd(common commonCmd) compileCmd {
+	cmd := &compileCmd{}
+	cmd.commonCmd = common
+	setupCmdFlags(cmd, "compile", cmd.usage)
+	cmd.out = cmd.flags.StringP("out", "o", "", "# Output file. Default: stdout")
+	return *cmd
+}
+
+func (cmd *compileCmd) usage() {
+	const help = `Summary:
+  Make a standalone shell script which runs without {{.Prog}}.
+  Calls of "include <package> <file>" in the script are replaced with contents of the files in
+  installed packages. Included files are processed recursively, and each of them is loaded only
+  once at runtime. Comments tell the package, its origin and commit of each included file.
+
+  Contents of an included file are put only at the first "include" of it, in place of the call
+  like sourced file. Later "include" of the same file is left as comments, so the first one should
+  be run before them. "return" at top level of included files, and "$0" and BASH_SOURCE which
+  refer to the compiled script instead of the files, are warned.
+
+Syntax:
+  {{.Prog}} {{.Cmd}} <script> [-o|--out <file>]
+
+  Only "include" with literal arguments on its own line is replaced. The output is for POSIX
+  compatible shells.
+
+Options:
+`
+
+	t := template.Must(template.New("usage").Parse(help))
+	t.Execute(cmd.errs, struct{ Prog, Cmd string }{cmd.name, "compile"})
+
+	cmd.flags.PrintDefaults()
+}
+
+func (cmd *compileCmd) parseAndExec(args []string) error {
+	done, err := parseStart(cmd, args, true, true)
+	if done || err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cmd, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	script := cmd.flags.Arg(0)
+	info, err := os.Stat(script)
+	if err != nil {
+		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+		return ErrArgument
+	}
+
+	c := &scriptCompiler{cmd: cmd, loading: make(map[string]bool), inlined: make(map[string]site)}
+	fmt.Fprintf(&c.buf, "# Compiled by \"%s compile\" from %s\n", cmd.name, filepath.Base(script))
+	if err = c.compile(script, false); err != nil {
+		return err
+	}
+
+	if *cmd.out == "" || *cmd.out == "-" {
+		_, err = cmd.outs.Write(c.buf.Bytes())
+		return err
+	}
+	if err = ioutil.WriteFile(*cmd.out, c.buf.Bytes(), info.Mode().Perm()); err != nil {
+		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	if *cmd.getVerboseOpts().getVerbose() {
+		fmt.Fprintf(cmd.errs, "Wrote %s\n", *cmd.out)
+	}
+	return nil
+}
+
+// scriptCompiler inlines files included by a script
+type scriptCompiler struct {
+	cmd *compileCmd
+	buf bytes.Buffer
+	// Files being inlined, to cut off cyclic inclusion
+	loading map[string]bool
+	// Where files are inlined
+	inlined map[string]site
+}
+
+// site is a line of "include" call
+type site struct {
+	path   string
+	num    int
+	indent string
+}
+
+// compile writes contents of the file into buffer inlining included files. Shebang of included
+// file is dropped, while that of the script is moved before the header
+func (c *scriptCompiler) compile(path string, included bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(c.cmd.errs, "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	// Depth of function definitions
+	depth := 0
+	for num := 1; scanner.Scan(); num++ {
+		line := scanner.Text()
+		if num == 1 && strings.HasPrefix(line, "#!") {
+			if !included {
+				header := c.buf.String()
+				c.buf.Reset()
+				fmt.Fprintf(&c.buf, "%s\n%s", line, header)
+			}
+			continue
+		}
+
+		matched := includeStatement.FindStringSubmatch(line)
+		if matched == nil {
+			if includeLike.MatchString(line) {
+				fmt.Fprintf(
+					c.cmd.errs, "Warning! Can't resolve \"include\" at %s:%d. Left as is\n", path, num)
+			}
+			switch {
+			case functionStart.MatchString(line):
+				depth++
+			case blockEnd.MatchString(line) && depth > 0:
+				depth--
+			}
+			if included && scriptPathLike.MatchString(line) {
+				fmt.Fprintf(
+					c.cmd.errs, "Warning! Path of script at %s:%d will be the compiled script\n",
+					path, num)
+			}
+			if included && depth == 0 && returnLike.MatchString(line) {
+				fmt.Fprintf(
+					c.cmd.errs, "Warning! \"return\" at %s:%d will be at top level of the compiled "+
+						"script\n", path, num)
+			}
+			c.buf.WriteString(line + "\n")
+			continue
+		}
+
+		pkg, file := unquoteWord(matched[2]), unquoteWord(matched[3])
+		at := site{path: path, num: num, indent: matched[1]}
+		if err = c.inline(pkg, file, at); err != nil {
+			fmt.Fprintf(c.cmd.errs, "Error! Can't include \"%s %s\" at %s:%d\n", pkg, file, path, num)
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// inline writes a file in a package guarded to be loaded once, and comments of provenance. The
+// file is written only at the first site, and later sites are left as comments
+func (c *scriptCompiler) inline(pkg, file string, at site) error {
+	pkgPath := filepath.Join(c.cmd.config.PackagePath(), pkg)
+	if _, err := os.Stat(pkgPath); err != nil {
+		fmt.Fprintf(c.cmd.errs, "Error! Package not installed: %s\n", pkg)
+		return ErrOperationFailed
+	}
+	path, ok := packageFile(pkgPath, file)
+	if !ok {
+		fmt.Fprintf(c.cmd.errs, "Error! File is out of package: %s\n", file)
+		return ErrArgument
+	}
+	if *c.cmd.getVerboseOpts().getVerbose() {
+		fmt.Fprintf(c.cmd.errs, "Include %s\n", path)
+	}
+
+	indent := at.indent
+	if first, ok := c.inlined[path]; ok {
+		fmt.Fprintf(
+			&c.buf, "%s# === include %s %s (inlined at %s:%d)\n",
+			indent, pkg, file, filepath.Base(first.path), first.num)
+		if first.indent != "" && !c.loading[path] {
+			fmt.Fprintf(
+				c.cmd.errs, "Warning! \"include %s %s\" at %s:%d relies on the first one at %s:%d "+
+					"which is in a block\n", pkg, file, at.path, at.num, first.path, first.num)
+		}
+		return nil
+	}
+	c.inlined[path] = at
+
+	guard := "__shelp_included_" + includeName(pkg, file)
+	fmt.Fprintf(&c.buf, "%s# >>> include %s %s (%s)\n", indent, pkg, file, provenance(c.cmd, pkg))
+	fmt.Fprintf(&c.buf, "%sif [ -z \"${%s:-}\" ]; then\n", indent, guard)
+	fmt.Fprintf(&c.buf, "%s%s=1\n", indent, guard)
+	c.loading[path] = true
+	err := c.compile(path, true)
+	delete(c.loading, path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&c.buf, "%sfi\n", indent)
+	fmt.Fprintf(&c.buf, "%s# <<< include %s %s\n", indent, pkg, file)
+	return nil
+}
+
+// provenance tells where a package comes from by its receipt
+func provenance(cmd runner, pkg string) string {
+	rc, ok := loadReceipt(cmd.getConfig(), pkg)
+	switch {
+	case !ok:
+		return "unknown origin"
+	case rc.Mode == modeLink:
+		return "linked from " + rc.From
+	}
+	origin := rc.URL
+	if origin == "" {
+		origin = rc.From
+	}
+	if rc.Ref != "" {
+		origin += " " + rc.Ref
+	}
+	if rc.Commit != "" {
+		origin += " @ " + rc.Commit
+	}
+	return origin
+}
+
+// includeName returns name which identifies a file in a package in names of variables. Hash of
+// the file distinguishes ones which differ only in non-word characters
+func includeName(pkg, file string) string {
+	name := nonWordChars.ReplaceAllString(pkg+"__"+file, "_")
+	return fmt.Sprintf("%s_%08x", name, crc32.ChecksumIEEE([]byte(pkg+"/"+file)))
+}
+
+// unquoteWord removes quotes around a word of shell
+func unquoteWord(word string) string {
+	if len(word) >= 2 && (word[0] == '\'' || word[0] == '"') && word[len(word)-1] == word[0] {
+		return word[1 : len(word)-1]
+	}
+	return word
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/progrhyme/shelp/internal/semver"
+)
+
+// resolveConstraint returns the newest tag in remote repository which satisfies version constraint.
+// It returns empty string when no tag satisfies it
+func resolveConstraint(cmd gitRunner, url, constraint string) (string, error) {
+	c, err := semver.ParseConstraint(constraint)
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return "", ErrArgument
+	}
+	tags, err := cmd.getGit().RemoteTags(url, *cmd.getVerboseOpts().getVerbose())
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't get tags of %s\n", url)
+		return "", ErrCommandFailed
+	}
+	tag, _ := c.Resolve(tags)
+	return tag, nil
+}
+
+// checkUpdate tells whether the package has update. A package with version constraint has update
+// when newer tag satisfying the constraint is found in remote repository
+func checkUpdate(cmd gitRunner, name string) (bool, error) {
+	rc, ok := loadReceipt(cmd.getConfig(), name)
+	if !ok || rc.Constraint == "" {
+		return checkBranchUpdate(cmd, name)
+	}
+
+	tag, err := resolveConstraint(cmd, rc.URL, rc.Constraint)
+	if err != nil {
+		return false, err
+	}
+	return tag != "" && tag != rc.Ref, nil
+}
+
+// checkBranchUpdate tells whether the branch checked out in the package is behind the one in remote
+// repository. It runs "git ls-remote" not to fetch into the package
+func checkBranchUpdate(cmd gitRunner, name string) (bool, error) {
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	verbose := *cmd.getVerboseOpts().getVerbose()
+	wt, err := cmd.getGit().Worktree(path, verbose)
+	if err != nil {
+		return false, err
+	}
+	if wt.Branch == "" {
+		// Detached HEAD, no need to update
+		return false, nil
+	}
+	upstream := wt.UpstreamBranch()
+	commit, err := cmd.getGit().RemoteCommit(wt.RemoteURL, upstream, verbose)
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't get remote branch %s of \"%s\"\n", upstream, name)
+		return false, err
+	}
+	return commit != wt.Commit, nil
+}
@@ -0,0 +1,300 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/progrhyme/shelp/internal/config"
+)
+
+// modeDependency is for a package installed as dependency of another package
+const modeDependency = "dependency"
+
+// installSession is state shared by packages installed in an invocation of command, i.e. ones
+// installed in parallel and their dependencies
+type installSession struct {
+	mutex sync.Mutex
+	// Closed when installation of the package finishes
+	installing map[string]chan struct{}
+	// Package whose installation waits for another one to install it as dependency
+	waiting map[string]string
+	// Lock file to install dependencies by. Set by "bundle --frozen"
+	frozen *config.Lock
+}
+
+func newInstallSession() *installSession {
+	return &installSession{
+		installing: make(map[string]chan struct{}),
+		waiting:    make(map[string]string),
+	}
+}
+
+// claim lets the caller install the package exclusively in the session. It waits for another
+// installation of the same package to finish. Chain is dependents of the package being installed
+// by the caller. It returns function to release the claim
+func (s *installSession) claim(cmd runner, name string, chain []string) (func(), error) {
+	var dependent string
+	if len(chain) > 0 {
+		dependent = chain[len(chain)-1]
+	}
+	for {
+		s.mutex.Lock()
+		done, busy := s.installing[name]
+		if !busy {
+			done = make(chan struct{})
+			s.installing[name] = done
+			s.mutex.Unlock()
+			return func() {
+				s.mutex.Lock()
+				delete(s.installing, name)
+				s.mutex.Unlock()
+				close(done)
+			}, nil
+		}
+		if dependent != "" {
+			// Installation of the package may wait for the dependent through its dependencies
+			for pkg := name; pkg != ""; pkg = s.waiting[pkg] {
+				if pkg == dependent {
+					s.mutex.Unlock()
+					fmt.Fprintf(
+						cmd.getErrs(), "Error! Dependency cycle between \"%s\" and \"%s\"\n",
+						dependent, name)
+					return nil, ErrArgument
+				}
+			}
+			s.waiting[dependent] = name
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-done:
+		case <-cmd.getContext().Done():
+		}
+		s.mutex.Lock()
+		delete(s.waiting, dependent)
+		s.mutex.Unlock()
+		if interrupted(cmd) {
+			return nil, ErrInterrupted
+		}
+	}
+}
+
+// configuredArgs returns installArgs of a package configured in config file
+func configuredArgs(cmd verboseRunner, name string) (installArgs, bool) {
+	for _, param := range cmd.getConfig().Packages {
+		args := installArgs{
+			from:      param.From,
+			as:        param.As,
+			at:        param.At,
+			bin:       param.Bin,
+			depends:   param.Depends,
+			overwrite: true,
+			mode:      modeBundle,
+		}
+		pkg, err := packageToInstall(cmd, args)
+		if err == nil && param.From != "" && pkg.name == name {
+			return args, true
+		}
+	}
+	return installArgs{}, false
+}
+
+// isNameReference tells whether a dependency is specified by package name rather than location
+func isNameReference(spec string) bool {
+	return !strings.ContainsAny(spec, "/:")
+}
+
+// installDependencies installs dependencies of a package which are not installed yet. Dependencies
+// are specified by package name, or by location in the same syntax as "install" command
+func installDependencies(cmd gitRunner, args installArgs, name string, depends []string) error {
+	chain := append(append([]string{}, args.chain...), name)
+
+	for _, spec := range depends {
+		depArgs, configured := configuredArgs(cmd, spec)
+		if !configured {
+			depArgs = installArgs{from: spec, mode: modeDependency}
+		}
+		dep, err := packageToInstall(cmd, depArgs)
+		if err != nil {
+			return err
+		}
+		if !configured && !isNameReference(spec) {
+			// Configured package takes precedence over one specified by location
+			if confArgs, ok := configuredArgs(cmd, dep.name); ok {
+				depArgs, configured = confArgs, true
+			}
+		}
+
+		for i, ancestor := range chain {
+			if ancestor == dep.name {
+				fmt.Fprintf(
+					cmd.getErrs(), "Error! Dependency cycle: %s -> %s\n",
+					strings.Join(chain[i:], " -> "), dep.name)
+				return ErrArgument
+			}
+		}
+
+		if frozen := args.session.frozen; frozen != nil && !configured && !isNameReference(spec) {
+			locked, ok := frozen.Find(dep.name)
+			if !ok || !locked.Dependency || locked.From != spec || locked.Commit == "" {
+				fmt.Fprintf(
+					cmd.getErrs(), "Error! Dependency \"%s\" of \"%s\" is not found in lock file\n",
+					dep.name, name)
+				return ErrConfig
+			}
+			// Installed one is replaced unless it is at the locked commit
+			depArgs.commit = locked.Commit
+			depArgs.overwrite = true
+			depArgs.strategy = args.strategy
+		}
+
+		depPath := filepath.Join(cmd.getConfig().PackagePath(), dep.name)
+		if _, err := os.Stat(depPath); !os.IsNotExist(err) {
+			if depArgs.commit == "" {
+				if err = checkDependencyConflict(cmd, name, spec, dep, configured); err != nil {
+					return err
+				}
+				continue
+			}
+		} else if isNameReference(spec) && !configured {
+			fmt.Fprintf(
+				cmd.getErrs(),
+				"Error! Dependency \"%s\" of \"%s\" is neither installed nor configured\n", spec, name)
+			return ErrArgument
+		} else {
+			fmt.Fprintf(cmd.getOuts(), "Install \"%s\" as dependency of \"%s\"\n", dep.name, name)
+		}
+
+		depArgs.chain = chain
+		depArgs.session = args.session
+		// Another package installed in parallel may install it first
+		err = installPackage(cmd, depArgs)
+		if err != nil && err != ErrWarning && err != ErrAlreadyInstalled {
+			fmt.Fprintf(
+				cmd.getErrs(), "Error! Dependency \"%s\" of \"%s\" is not installed\n", dep.name, name)
+			return ErrOperationFailed
+		}
+	}
+	return nil
+}
+
+// checkDependencyConflict verifies an installed package meets version required by its dependent
+func checkDependencyConflict(cmd gitRunner, name, spec string, dep shelpkg, configured bool) error {
+	if isNameReference(spec) || configured || isLinkedPackage(cmd, dep.name) {
+		// Whatever installed is accepted
+		return nil
+	}
+	if isDryRun(cmd) {
+		return nil
+	}
+	now, err := packageInstalled(cmd, filepath.Join(cmd.getConfig().PackagePath(), dep.name))
+	if err != nil {
+		return err
+	}
+	if dep.url != now.url || ((dep.ref != "" || dep.constraint != "") && !dep.isEquivalent(now)) {
+		fmt.Fprintf(
+			cmd.getErrs(),
+			"Error! Version conflict on \"%s\": \"%s\" requires %s, but installed is %s@%s\n",
+			dep.name, name, spec, now.url, now.ref)
+		return ErrOperationFailed
+	}
+	return nil
+}
+
+// dependentsOf returns names of installed packages which depend on the package
+func dependentsOf(cmd runner, name string) []string {
+	dependents := []string{}
+	files, err := ioutil.ReadDir(cmd.getConfig().ReceiptPath())
+	if err != nil {
+		return dependents
+	}
+	for _, file := range files {
+		other := strings.TrimSuffix(file.Name(), ".json")
+		rc, ok := loadReceipt(cmd.getConfig(), other)
+		if !ok || other == name {
+			continue
+		}
+		for _, dep := range rc.Depends {
+			if dep == name {
+				dependents = append(dependents, other)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// sortByDependency divides packages into groups in order of installation. Packages in a group
+// depend only on ones in former groups, so that they can be installed in parallel
+func sortByDependency(names []string, depends map[string][]string) ([][]string, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	level := make(map[string]int)
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[name] = true
+	}
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			for i, ancestor := range path {
+				if ancestor == name {
+					cycle := strings.Join(append(path[i:], name), " -> ")
+					return fmt.Errorf("Dependency cycle: %s", cycle)
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range depends[name] {
+			if !known[dep] {
+				continue
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+			if level[dep]+1 > level[name] {
+				level[name] = level[dep] + 1
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	groups := [][]string{}
+	for _, name := range names {
+		if err := visit(name, []string{}); err != nil {
+			return groups, err
+		}
+		for len(groups) <= level[name] {
+			groups = append(groups, []string{})
+		}
+	}
+	for _, name := range names {
+		groups[level[name]] = append(groups[level[name]], name)
+	}
+	return groups, nil
+}
+
+// dependencyNames converts specs of dependencies into package names
+func dependencyNames(cmd verboseRunner, depends []string) []string {
+	names := []string{}
+	for _, spec := range depends {
+		if dep, err := packageToInstall(cmd, installArgs{from: spec}); err == nil {
+			names = append(names, dep.name)
+		}
+	}
+	return names
+}
@@ -2,8 +2,11 @@ package cli
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/progrhyme/shelp/internal/config"
@@ -13,7 +16,9 @@ import (
 type destroyCmd struct {
 	commonCmd
 	option struct {
-		yes *bool
+		yes    *bool
+		dryRun *bool
+		wait   *time.Duration
 		commonOpts
 	}
 }
@@ -27,6 +32,9 @@ func newDestroyCmd(common commonCmd) destroyCmd {
 	cmd.commonCmd = common
 	setupCmdFlags(cmd, "destroy", cmd.usage)
 	cmd.option.yes = cmd.flags.BoolP("yes", "y", false, "# Destroy without confirmation")
+	cmd.option.dryRun = cmd.flags.Bool("dry-run", false, "# Report operations without doing them")
+	cmd.option.wait = cmd.flags.Duration(
+		"wait", 0, "# Time to wait for another running shelp; e.g. 30s")
 	return *cmd
 }
 
@@ -35,7 +43,7 @@ func (cmd *destroyCmd) usage() {
   Delete all contents in %s including the root directory.
 
 Syntax:
-  %s destroy [-y|--yes]
+  %s destroy [-y|--yes] [--dry-run] [--wait DURATION]
 
 Options:
 `, config.RootVarName, cmd.name)
@@ -54,6 +62,17 @@ func (cmd *destroyCmd) parseAndExec(args []string) error {
 		return ErrOperationFailed
 	}
 
+	unlock, err := lockRootFor(cmd, !*cmd.option.dryRun, *cmd.option.wait)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if *cmd.option.dryRun {
+		cmd.report(root)
+		return nil
+	}
+
 	if isatty.IsTerminal(os.Stdin.Fd()) {
 		if !*cmd.option.yes {
 			fmt.Fprintf(cmd.outs, `Delete all contents in %s including packages and the directory itself.
@@ -78,3 +97,18 @@ Are you sure? (y/N) `, root)
 	fmt.Fprintf(cmd.outs, "Deleted: %s\n", root)
 	return nil
 }
+
+// report shows contents to be deleted in dry-run mode
+func (cmd *destroyCmd) report(root string) {
+	dirs := []string{cmd.config.PackagePath(), cmd.config.BinPath(), cmd.config.TempPath()}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			wouldDo(cmd, "remove %s", filepath.Join(dir, file.Name()))
+		}
+	}
+	wouldDo(cmd, "remove %s", root)
+}
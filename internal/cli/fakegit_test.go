@@ -0,0 +1,1603 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/progrhyme/shelp/internal/config"
+	"github.com/progrhyme/shelp/internal/git"
+)
+
+// fakeRepo is a remote repository served by fakeGit
+type fakeRepo struct {
+	Branch string
+	Commit string
+	// Executable files in the repository
+	Bins []string
+	// Tags to commits
+	Tags map[string]string
+	// Branches other than the default one to commits
+	Heads map[string]string
+	// Other files in the repository; path to content
+	Files map[string]string
+	// Time taken by Clone of the repository
+	Delay time.Duration `json:"-"`
+}
+
+// fakeGit is a git backend which "clones" repositories defined in memory.
+// State of a working tree is stored in its ".git" file.
+type fakeGit struct {
+	repos map[string]fakeRepo
+	ctx   context.Context
+	// Called in the middle of Clone to simulate interruption
+	onClone func()
+	// Errors returned by Clone in order before it succeeds. Shared with copies by WithContext
+	cloneErrors chan error
+	// Time taken by Clone
+	cloneDelay time.Duration
+	// Stash is not supported like go-git backend
+	noStash bool
+	// Counts calls of RemoteCommit if set
+	remoteCalls *int32
+}
+
+type fakeWorktree struct {
+	URL string
+	fakeRepo
+	// Remote branch tracked by the local branch if it has another name
+	Upstream string
+	// Local changes made in the working tree
+	Changes  []string
+	Unpushed int
+}
+
+func (g *fakeGit) Clone(src, dst string, opts git.Option) error {
+	if g.cloneDelay > 0 {
+		ctx := g.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(g.cloneDelay):
+		}
+	}
+	select {
+	case err := <-g.cloneErrors:
+		return err
+	default:
+	}
+	repo, ok := g.repos[src]
+	if !ok {
+		return fmt.Errorf("Repository not found: %s", src)
+	}
+	// git refuses to clone into existing directory
+	if err := os.Mkdir(dst, 0755); err != nil {
+		return err
+	}
+	time.Sleep(repo.Delay)
+	if err := os.MkdirAll(filepath.Join(dst, "bin"), 0755); err != nil {
+		return err
+	}
+	for _, bin := range repo.Bins {
+		if err := ioutil.WriteFile(filepath.Join(dst, "bin", bin), []byte("#!/bin/sh\n"), 0755); err != nil {
+			return err
+		}
+	}
+	for path, content := range repo.Files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dst, path)), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, path), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	if g.onClone != nil {
+		g.onClone()
+	}
+	if g.ctx != nil && g.ctx.Err() != nil {
+		// Partial clone is left as killed git does
+		return g.ctx.Err()
+	}
+	if opts.Commit != "" {
+		repo.Branch = ""
+		repo.Commit = opts.Commit
+	} else if commit, ok := repo.Tags[opts.Branch]; ok {
+		repo.Branch = ""
+		repo.Commit = commit
+	} else if opts.Branch != "" {
+		repo.Branch = opts.Branch
+	}
+	return g.save(dst, fakeWorktree{URL: src, fakeRepo: repo})
+}
+
+func (g *fakeGit) Checkout(dir, ref string, verbose bool) error {
+	wt, err := g.load(dir)
+	if err != nil {
+		return err
+	}
+	repo := g.repos[wt.URL]
+	if commit, ok := repo.Tags[ref]; ok {
+		wt.Branch = ""
+		wt.Commit = commit
+	} else if ref == repo.Branch {
+		wt.Branch = ref
+	} else {
+		wt.Branch = ""
+		wt.Commit = ref
+	}
+	return g.save(dir, wt)
+}
+
+func (g *fakeGit) RemoteCommit(url, branch string, verbose bool) (string, error) {
+	if g.remoteCalls != nil {
+		atomic.AddInt32(g.remoteCalls, 1)
+	}
+	repo, ok := g.repos[url]
+	if !ok {
+		return "", fmt.Errorf("Repository not found: %s", url)
+	}
+	if commit, ok := repo.Heads[branch]; ok {
+		return commit, nil
+	}
+	return repo.Commit, nil
+}
+
+func (g *fakeGit) Pull(dir string, verbose bool) error {
+	wt, err := g.load(dir)
+	if err != nil {
+		return err
+	}
+	if wt.Branch == "" {
+		return errors.New("You are not currently on a branch")
+	}
+	wt.Commit = g.repos[wt.URL].Commit
+	return g.save(dir, wt)
+}
+
+func (g *fakeGit) CheckoutTag(dir, tag string, verbose bool) error {
+	wt, err := g.load(dir)
+	if err != nil {
+		return err
+	}
+	commit, ok := g.repos[wt.URL].Tags[tag]
+	if !ok {
+		return fmt.Errorf("Tag not found: %s", tag)
+	}
+	wt.Branch = ""
+	wt.Commit = commit
+	return g.save(dir, wt)
+}
+
+func (g *fakeGit) RemoteTags(url string, verbose bool) ([]string, error) {
+	tags := []string{}
+	for tag := range g.repos[url].Tags {
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func (g *fakeGit) Status(dir string, verbose bool) (git.Status, error) {
+	wt, err := g.load(dir)
+	if err != nil {
+		return git.Status{}, err
+	}
+	return git.Status{Changes: wt.Changes, Unpushed: wt.Unpushed}, nil
+}
+
+func (g *fakeGit) Stash(dir string, verbose bool) error {
+	if g.noStash {
+		return git.ErrNotSupported
+	}
+	wt, err := g.load(dir)
+	if err != nil {
+		return err
+	}
+	wt.Changes = nil
+	return g.save(dir, wt)
+}
+
+func (g *fakeGit) Discard(dir string, verbose bool) error {
+	wt, err := g.load(dir)
+	if err != nil {
+		return err
+	}
+	wt.Changes = nil
+	wt.Unpushed = 0
+	return g.save(dir, wt)
+}
+
+func (g *fakeGit) Worktree(dir string, verbose bool) (git.Worktree, error) {
+	wt, err := g.load(dir)
+	if err != nil {
+		return git.Worktree{}, err
+	}
+	tree := git.Worktree{
+		RemoteURL:     wt.URL,
+		Branch:        wt.Branch,
+		Upstream:      wt.Upstream,
+		Commit:        wt.Commit,
+		DefaultBranch: g.repos[wt.URL].Branch,
+	}
+	for tag, commit := range g.repos[wt.URL].Tags {
+		if commit == wt.Commit {
+			tree.Tag = tag
+		}
+	}
+	return tree, nil
+}
+
+func (g *fakeGit) WithOutput(out, err io.Writer) git.Backend {
+	return g
+}
+
+func (g *fakeGit) WithContext(ctx context.Context) git.Backend {
+	c := *g
+	c.ctx = ctx
+	return &c
+}
+
+func (g *fakeGit) load(dir string) (fakeWorktree, error) {
+	wt := fakeWorktree{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".git"))
+	if err != nil {
+		return wt, err
+	}
+	err = json.Unmarshal(data, &wt)
+	return wt, err
+}
+
+func (g *fakeGit) save(dir string, wt fakeWorktree) error {
+	data, err := json.Marshal(wt)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ".git"), data, 0644)
+}
+
+// newFakeEnv makes a temporary directory whose "root" is SHELP_ROOT, and returns config and
+// fakeGit serving the repositories, with a function to run shelp in the environment. The
+// directory is removed when the test finishes
+func newFakeEnv(
+	t *testing.T, repos map[string]fakeRepo) (*config.Config, *fakeGit, func(...string) (string, error)) {
+	tmpDir, err := ioutil.TempDir("", "shelp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	cfg := config.NewConfig(os.Stdout, os.Stderr)
+	cfg.Path.Root = filepath.Join(tmpDir, "root")
+	fake := &fakeGit{repos: repos}
+	run := func(args ...string) (string, error) {
+		out := &strings.Builder{}
+		ctl := NewCli("0.0.1", &cfg, fake, out, out)
+		err := ctl.ParseAndExec(append([]string{"shelp"}, args...))
+		return out.String(), err
+	}
+	return &cfg, fake, run
+}
+
+// Run install, upgrade and remove with fakeGit which requires no network
+func TestWorkflowWithFakeGit(t *testing.T) {
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/foo.git":    {Branch: "main", Commit: "1111111", Bins: []string{"foo"}},
+		"https://github.com/example/foobar.git": {Branch: "main", Commit: "2222222", Bins: []string{"foobar"}},
+	})
+
+	for _, repo := range []string{"example/foo", "example/foobar"} {
+		if out, err := run("install", repo); err != nil {
+			t.Errorf("Install failed. Error = %v, Output = %s", err, out)
+		}
+	}
+	for _, bin := range []string{"foo", "foobar"} {
+		if _, err := os.Readlink(filepath.Join(cfg.BinPath(), bin)); err != nil {
+			t.Errorf("Bin not installed: %s. Error = %v", bin, err)
+		}
+	}
+
+	if out, err := run("upgrade", "foo"); err != nil || !strings.Contains(out, "No need to upgrade") {
+		t.Errorf("Unexpected upgrade result. Error = %v, Output = %s", err, out)
+	}
+	repo := fake.repos["https://github.com/example/foo.git"]
+	repo.Commit = "3333333"
+	fake.repos["https://github.com/example/foo.git"] = repo
+	if out, err := run("outdated"); err != nil || out != "foo\n" {
+		t.Errorf("Unexpected outdated result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade", "foo"); err != nil || strings.Contains(out, "No need to upgrade") {
+		t.Errorf("Unexpected upgrade result. Error = %v, Output = %s", err, out)
+	}
+
+	out, err := run("remove", "--dry-run", "foo")
+	if err != nil || !strings.Contains(out, "Would remove") {
+		t.Errorf("Unexpected dry-run result. Error = %v, Output = %s", err, out)
+	}
+	if _, ok := loadReceipt(cfg, "foo"); !ok {
+		t.Error("Package is removed in dry-run mode: foo")
+	}
+
+	if out, err := run("remove", "foo"); err != nil {
+		t.Errorf("Remove failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("list"); err != nil || out != "foobar\n" {
+		t.Errorf("Unexpected list result. Error = %v, Output = %s", err, out)
+	}
+	if _, err := os.Readlink(filepath.Join(cfg.BinPath(), "foobar")); err != nil {
+		t.Errorf("Bin of other package is removed: foobar. Error = %v", err)
+	}
+	if _, ok := loadReceipt(cfg, "foo"); ok {
+		t.Error("Receipt of removed package remains: foo")
+	}
+	if rc, ok := loadReceipt(cfg, "foobar"); !ok || rc.Commit != "2222222" || rc.Mode != modeInstall {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+}
+
+// Install a package by version constraint and upgrade it within the constraint
+func TestVersionConstraintWithFakeGit(t *testing.T) {
+	const url = "https://github.com/example/baz.git"
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		url: {Branch: "main", Commit: "4444444", Bins: []string{"baz"}, Tags: map[string]string{
+			"v1.0.0": "1000000", "v1.2.0": "1200000", "v2.0.0": "2000000",
+		}},
+	})
+
+	out, err := run("install", "example/baz@^1")
+	if err != nil || !strings.Contains(out, "Resolved \"^1\" to tag v1.2.0") {
+		t.Errorf("Unexpected install result. Error = %v, Output = %s", err, out)
+	}
+	if rc, ok := loadReceipt(cfg, "baz"); !ok || rc.Ref != "v1.2.0" || rc.Constraint != "^1" {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+
+	if out, err := run("outdated"); err != nil || out != "" {
+		t.Errorf("Unexpected outdated result. Error = %v, Output = %s", err, out)
+	}
+	fake.repos[url].Tags["v1.3.0"] = "1300000"
+	if out, err := run("outdated"); err != nil || out != "" {
+		t.Errorf("Cached result is not used. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("outdated", "--refresh"); err != nil || out != "baz\n" {
+		t.Errorf("Unexpected outdated result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade", "baz"); err != nil {
+		t.Errorf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	if rc, ok := loadReceipt(cfg, "baz"); !ok || rc.Ref != "v1.3.0" || rc.Commit != "1300000" {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+}
+
+// Install a package which has manifest file
+func TestManifestWithFakeGit(t *testing.T) {
+	cfg, fake, _ := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/qux.git": {
+			Branch: "main", Commit: "5555555", Bins: []string{"qux", "qux-helper"},
+			Files: map[string]string{
+				config.ManifestFileName: `bin:
+  - bin/qux
+source:
+  - qux.sh
+requires:
+  - shelp-no-such-command
+`,
+			},
+		},
+	})
+
+	out := &strings.Builder{}
+	ctl := NewCli("0.0.1", cfg, fake, out, out)
+	if err := ctl.ParseAndExec([]string{"shelp", "install", "example/qux"}); err != nil {
+		t.Errorf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	if !strings.Contains(out.String(), "requires command \"shelp-no-such-command\"") {
+		t.Errorf("No warning for required command. Output = %s", out)
+	}
+	if _, err := os.Readlink(filepath.Join(cfg.BinPath(), "qux-helper")); err == nil {
+		t.Error("Bin not declared in manifest is linked: qux-helper")
+	}
+	rc, ok := loadReceipt(cfg, "qux")
+	if !ok || len(rc.Bins) != 1 || rc.Bins[0] != "qux" || len(rc.Source) != 1 {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+}
+
+// Files out of package listed in manifest are not linked
+func TestOutOfPackageWithFakeGit(t *testing.T) {
+	cfg, _, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/qux.git": {
+			Branch: "main", Commit: "5555555", Bins: []string{"qux"},
+			Files: map[string]string{
+				config.ManifestFileName: `bin:
+  - bin/qux
+  - ../../bin/qux
+completions:
+  - ../qux.zsh
+man:
+  - ../../qux.1
+`,
+			},
+		},
+	})
+
+	out, err := run("install", "example/qux")
+	if err != ErrWarning || strings.Count(out, "Warning! File is out of package") != 3 {
+		t.Errorf("Unexpected result. Error = %v, Output = %s", err, out)
+	}
+	if _, err := os.Readlink(filepath.Join(cfg.BinPath(), "qux")); err != nil {
+		t.Errorf("Bin in package is not linked. Error = %v", err)
+	}
+	for _, sym := range []string{"zsh/site-functions/_qux", "man/man1/qux.1"} {
+		if _, err := os.Lstat(filepath.Join(cfg.ShellSharePath(), sym)); err == nil {
+			t.Errorf("File out of package is linked: %s", sym)
+		}
+	}
+	rc, ok := loadReceipt(cfg, "qux")
+	if !ok || len(rc.Bins) != 1 || len(rc.Completions) != 0 || len(rc.Man) != 0 {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+}
+
+// Completions and man pages are linked into share directory
+func TestShareWithFakeGit(t *testing.T) {
+	cfg, fake, _ := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/foo.git": {
+			Branch: "main", Commit: "1111111",
+			Files: map[string]string{
+				"completions/_foo":        "#compdef foo\n",
+				"completions/foo.bash":    "complete -F _foo foo\n",
+				"completions/foo.fish":    "complete -c foo\n",
+				"completions/README.md":   "# Completions\n",
+				"man/foo.1":               ".TH FOO 1\n",
+				"functions/foo_util.fish": "function foo_util; end\n",
+				"functions/_foo_util":     "#autoload\n",
+			},
+		},
+		"https://github.com/example/bar.git": {
+			Branch: "main", Commit: "2222222",
+			Files: map[string]string{
+				config.ManifestFileName:  "completions:\n  - etc/bar-completion.zsh\nman:\n  - doc/bar.5\n",
+				"etc/bar-completion.zsh": "#compdef bar\n",
+				"doc/bar.5":              ".TH BAR 5\n",
+				"man/unlisted.1":         ".TH UNLISTED 1\n",
+			},
+		},
+	})
+
+	out := &strings.Builder{}
+	ctl := NewCli("0.0.1", cfg, fake, out, out)
+	if err := ctl.ParseAndExec([]string{"shelp", "install", "example/foo"}); err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	if err := ctl.ParseAndExec([]string{"shelp", "install", "example/bar"}); err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+
+	links := map[string]string{
+		"zsh/site-functions/_foo":               "foo/completions/_foo",
+		"bash-completion/completions/foo":       "foo/completions/foo.bash",
+		"fish/vendor_completions.d/foo.fish":    "foo/completions/foo.fish",
+		"fish/vendor_functions.d/foo_util.fish": "foo/functions/foo_util.fish",
+		"zsh/site-functions/_foo_util":          "foo/functions/_foo_util",
+		"man/man1/foo.1":                        "foo/man/foo.1",
+		"zsh/site-functions/_bar":               "bar/etc/bar-completion.zsh",
+		"man/man5/bar.5":                        "bar/doc/bar.5",
+	}
+	for sym, src := range links {
+		got, err := os.Readlink(filepath.Join(cfg.ShellSharePath(), sym))
+		if err != nil || !strings.HasSuffix(got, filepath.Join("packages", src)) {
+			t.Errorf("Unexpected link %s -> %s. Error = %v", sym, got, err)
+		}
+	}
+	for _, sym := range []string{"bash-completion/completions/README", "man/man1/unlisted.1"} {
+		if _, err := os.Lstat(filepath.Join(cfg.ShellSharePath(), sym)); err == nil {
+			t.Errorf("Unexpected link: %s", sym)
+		}
+	}
+	rc, ok := loadReceipt(cfg, "foo")
+	if !ok || len(rc.Completions) != 5 || len(rc.Man) != 1 {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+
+	// Init script can be loaded again without duplicates in search paths
+	script := &strings.Builder{}
+	ctl = NewCli("0.0.1", cfg, fake, script, out)
+	if err := ctl.ParseAndExec([]string{"shelp", "init", "-", "sh"}); err != nil {
+		t.Fatalf("Init failed. Error = %v, Output = %s", err, out)
+	}
+	load := `unset MANPATH XDG_DATA_DIRS; eval "$1"; eval "$1"; echo "$MANPATH $XDG_DATA_DIRS"`
+	got, err := exec.Command("sh", "-c", load, "sh", script.String()).Output()
+	want := fmt.Sprintf(
+		"%s/man: %s:/usr/local/share:/usr/share\n", cfg.ShellSharePath(), cfg.ShellSharePath())
+	if err != nil || string(got) != want {
+		t.Errorf("Unexpected search paths. Error = %v, Got = %s, Want = %s", err, got, want)
+	}
+
+	if err := ctl.ParseAndExec([]string{"shelp", "remove", "foo"}); err != nil {
+		t.Fatalf("Remove failed. Error = %v, Output = %s", err, out)
+	}
+	for sym, src := range links {
+		_, err := os.Lstat(filepath.Join(cfg.ShellSharePath(), sym))
+		if removed := os.IsNotExist(err); removed != strings.HasPrefix(src, "foo/") {
+			t.Errorf("Link %s is removed = %v", sym, removed)
+		}
+	}
+}
+
+// Files of packages are sourced by init scripts
+func TestSourceWithFakeGit(t *testing.T) {
+	cfg, _, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/foo.git": {
+			Branch: "main", Commit: "1111111",
+			Files: map[string]string{
+				config.ManifestFileName: "source: [foo.sh]\nshells: [bash, zsh]\n",
+			},
+		},
+		"https://github.com/example/bar.git": {
+			Branch: "main", Commit: "2222222",
+			Files: map[string]string{config.ManifestFileName: "source: [bar.sh]\n"},
+		},
+		"https://github.com/example/baz.git": {
+			Branch: "main", Commit: "3333333",
+			Files: map[string]string{
+				config.ManifestFileName: "source: [baz.fish]\nshells: [fish]\n",
+			},
+		},
+		"https://github.com/example/qux.git": {
+			Branch: "main", Commit: "4444444",
+			Files: map[string]string{config.ManifestFileName: "source: [\"qux init.sh\"]\n"},
+		},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	cfgFile := filepath.Join(dir, "config.yml")
+	err := ioutil.WriteFile(cfgFile, []byte(`packages:
+- from: example/bar
+  source: [bar.zsh]
+  shells: [zsh]
+  defer: true
+- from: example/foo
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := run("bundle", "-c", cfgFile); err != nil {
+		t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	for _, pkg := range []string{"example/baz", "example/qux"} {
+		if out, err := run("install", pkg); err != nil {
+			t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+		}
+	}
+
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{"zsh", `
+# Scripts of packages
+include foo foo.sh
+include qux 'qux init.sh'
+_shelp_deferred() {
+  add-zsh-hook -d precmd _shelp_deferred
+  unfunction _shelp_deferred
+  include bar bar.zsh
+}
+`},
+		{"bash", `
+# Scripts of packages
+include foo foo.sh
+include qux 'qux init.sh'
+`},
+		{"fish", `
+# Scripts of packages
+include baz baz.fish
+include qux 'qux init.sh'
+`},
+		{"tcsh", "\ninclude qux 'qux init.sh';\n"},
+		{"pwsh", "\n# Scripts of packages\n. include qux 'qux init.sh'\n"},
+		{"nu", fmt.Sprintf(
+			"\n# Scripts of packages\n# File not found: %s\n",
+			filepath.Join(cfg.RootPath(), "packages", "qux", "qux init.sh"))},
+	}
+	for _, tt := range tests {
+		out, err := run("init", "-c", cfgFile, "-", tt.shell)
+		if err != nil || !strings.Contains(out, tt.want) {
+			t.Errorf("Unexpected init scripts for %s. Error = %v, Output = %s", tt.shell, err, out)
+		}
+		if tt.shell == "bash" && strings.Contains(out, "_shelp_deferred") {
+			t.Errorf("Package not for bash is deferred. Output = %s", out)
+		}
+	}
+}
+
+// Compiled init scripts are updated on changes of packages
+func TestCompileInitWithFakeGit(t *testing.T) {
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/foo.git": {
+			Branch: "main", Commit: "1111111",
+			Files: map[string]string{config.ManifestFileName: "source: [foo.sh]\n"},
+		},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	compiled := func(shell string) string {
+		data, err := ioutil.ReadFile(cfg.InitScriptFile(shell))
+		if err != nil {
+			t.Fatalf("Can't read compiled init scripts. Error = %v", err)
+		}
+		return string(data)
+	}
+
+	for _, shell := range []string{"zsh", "fish"} {
+		if out, err := run("init", "--compile", shell); err != nil {
+			t.Fatalf("Compile failed. Error = %v, Output = %s", err, out)
+		}
+		printed, _ := run("init", "-", shell)
+		if got := compiled(shell); !strings.HasSuffix(got, printed) {
+			t.Errorf("Compiled scripts differ from printed ones. Got = %s, Expected = %s", got, printed)
+		}
+	}
+	if out, err := run("init", "--compile", "../zsh"); err != ErrArgument {
+		t.Errorf("Invalid shell is accepted. Error = %v, Output = %s", err, out)
+	}
+
+	if out, err := run("install", "--dry-run", "example/foo"); err != nil ||
+		strings.Contains(compiled("zsh"), "include foo") {
+		t.Errorf("Compiled scripts are updated by dry-run. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("install", "example/foo"); err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	for _, shell := range []string{"zsh", "fish"} {
+		if !strings.Contains(compiled(shell), "include foo foo.sh") {
+			t.Errorf("Compiled scripts for %s are not updated on install", shell)
+		}
+	}
+	if out, err := run("remove", "foo"); err != nil {
+		t.Fatalf("Remove failed. Error = %v, Output = %s", err, out)
+	}
+	if strings.Contains(compiled("zsh"), "include foo") {
+		t.Error("Compiled scripts are not updated on remove")
+	}
+
+	// Scripts are recompiled with config file used by "init --compile"
+	cfgFile := filepath.Join(dir, "config.yml")
+	err := ioutil.WriteFile(cfgFile, []byte("packages:\n- from: example/foo\n  source: [bar.sh]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("init", "-c", cfgFile, "--compile", "zsh"); err != nil {
+		t.Fatalf("Compile failed. Error = %v, Output = %s", err, out)
+	}
+	backup := cfg.InitScriptFile("zsh.bak")
+	if err = ioutil.WriteFile(backup, []byte("# backup\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := config.NewConfig(os.Stdout, os.Stderr)
+	other.Path.Root = cfg.Path.Root
+	out := &strings.Builder{}
+	ctl := NewCli("0.0.1", &other, fake, out, out)
+	err = ctl.ParseAndExec([]string{"/opt/bin/shelp-dev", "install", "example/foo"})
+	if err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	if got := compiled("zsh"); !strings.Contains(got, "include foo bar.sh") {
+		t.Errorf("Scripts are not recompiled with config file. Got = %s", got)
+	}
+	if got := compiled("zsh"); !strings.HasPrefix(got, "# Generated by \"shelp-dev init --compile") {
+		t.Errorf("Header doesn't tell the program. Got = %s", got)
+	}
+	if data, _ := ioutil.ReadFile(backup); string(data) != "# backup\n" {
+		t.Errorf("File of unsupported shell is rewritten: %s", data)
+	}
+}
+
+// Included files are inlined into standalone script
+func TestCompileWithFakeGit(t *testing.T) {
+	cfg, _, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/foo.git": {
+			Branch: "main", Commit: "1111111",
+			Files: map[string]string{
+				"lib/a.sh": "#!/bin/sh\ninclude foo lib/b.sh\necho a\n",
+				"lib/b.sh": "include bar util.sh\necho b\n",
+			},
+		},
+		"https://github.com/example/bar.git": {
+			Branch: "main", Commit: "2222222",
+			Files: map[string]string{
+				"util.sh":  "include foo lib/a.sh # cyclic\necho util\n",
+				"args.sh":  "echo \"args $#\"\nnoop() {\n  return 0\n}\n",
+				"early.sh": "echo early\nif true; then\n  return\nfi\n",
+				"a-b.sh":   "echo a-b\n",
+				"a_b.sh":   "echo a_b\n",
+				"here.sh":  "here=$(dirname \"$0\")\n",
+			},
+		},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	for _, pkg := range []string{"example/foo", "example/bar"} {
+		if out, err := run("install", pkg); err != nil {
+			t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+		}
+	}
+
+	script := filepath.Join(dir, "script.sh")
+	err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+include foo lib/a.sh
+main() {
+  include "bar" 'util.sh'
+  echo main
+}
+main
+include foo "$file"
+include bar args.sh
+include bar a-b.sh
+include bar a_b.sh
+include bar here.sh
+include foo lib/a.sh
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled := filepath.Join(dir, "compiled.sh")
+	out, err := run("compile", script, "-o", compiled)
+	if err != nil {
+		t.Fatalf("Compile failed. Error = %v, Output = %s", err, out)
+	}
+	if !strings.Contains(out, "Can't resolve \"include\" at "+script+":8") {
+		t.Errorf("No warning for dynamic include. Output = %s", out)
+	}
+	if !strings.Contains(out, "Path of script at "+filepath.Join(cfg.PackagePath(), "bar", "here.sh")) {
+		t.Errorf("No warning for path of script. Output = %s", out)
+	}
+	data, err := ioutil.ReadFile(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"#!/bin/sh\n# Compiled by \"shelp compile\" from script.sh\n",
+		"# >>> include foo lib/a.sh (https://github.com/example/foo.git main @ 1111111)\n",
+		"# >>> include bar util.sh (https://github.com/example/bar.git main @ 2222222)\n",
+		"  # === include bar util.sh (inlined at b.sh:1)\n",
+		"include foo \"$file\"\n",
+		"# === include foo lib/a.sh (inlined at script.sh:2)\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Compiled script lacks %q. Got = %s", want, data)
+		}
+	}
+	if strings.Count(string(data), "echo a\n") != 1 || strings.Contains(out, "\"return\" at") {
+		t.Errorf("Unexpected compiled script. Output = %s, Got = %s", out, data)
+	}
+	// Each file is loaded once even if it is included cyclically, and sees arguments of the script
+	want := "util\nb\na\nmain\nargs 2\na-b\na_b\n"
+	if got, _ := exec.Command("sh", compiled, "x", "y").Output(); string(got) != want {
+		t.Errorf("Unexpected output of compiled script: %s", got)
+	}
+
+	ioutil.WriteFile(
+		script, []byte("include bar early.sh\nif true; then\n  include bar a-b.sh\nfi\n"+
+			"include bar a-b.sh\n"), 0644)
+	out, err = run("compile", script)
+	early := filepath.Join(cfg.PackagePath(), "bar", "early.sh")
+	for _, want := range []string{
+		"\"return\" at " + early + ":3 will be at top level",
+		"\"include bar a-b.sh\" at " + script + ":5 relies on the first one at " + script + ":3",
+	} {
+		if err != nil || !strings.Contains(out, want) {
+			t.Errorf("No warning %q. Error = %v, Output = %s", want, err, out)
+		}
+	}
+
+	out, err = run("compile", filepath.Join(dir, "no-such-script.sh"))
+	if err != ErrArgument {
+		t.Errorf("Unexpected result for missing script. Error = %v, Output = %s", err, out)
+	}
+	ioutil.WriteFile(script, []byte("include baz lib.sh\n"), 0644)
+	out, err = run("compile", script)
+	if err != ErrOperationFailed || !strings.Contains(out, "Package not installed: baz") {
+		t.Errorf("Unexpected result for missing package. Error = %v, Output = %s", err, out)
+	}
+}
+
+// Install packages in order of dependencies
+func TestDependenciesWithFakeGit(t *testing.T) {
+	cfg, _, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/app.git": {Branch: "main", Commit: "6666666"},
+		"https://github.com/example/lib.git": {
+			Branch: "main", Commit: "7777777",
+			Files: map[string]string{config.ManifestFileName: "depends:\n  - example/util\n"},
+		},
+		"https://github.com/example/util.git": {Branch: "main", Commit: "8888888"},
+		"https://github.com/example/loop.git": {
+			Branch: "main", Commit: "9999999",
+			Files: map[string]string{config.ManifestFileName: "depends:\n  - example/loop\n"},
+		},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	cfgFile := filepath.Join(dir, "config.yml")
+	err := ioutil.WriteFile(cfgFile, []byte(`packages:
+- from: example/app
+  depends: [lib]
+- from: example/lib
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run("bundle", "-c", cfgFile)
+	if err != nil {
+		t.Errorf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	lib, util := strings.Index(out, "\"lib\" is successfully"), strings.Index(out, "\"util\" is successfully")
+	app := strings.Index(out, "\"app\" is successfully")
+	if util < 0 || util > lib || lib > app {
+		t.Errorf("Unexpected order of installation. Output = %s", out)
+	}
+	if rc, ok := loadReceipt(cfg, "util"); !ok || rc.Mode != modeDependency {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+
+	if out, err := run("remove", "util"); err != ErrOperationFailed {
+		t.Errorf("Package required by others is removed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("remove", "--force", "util"); err != nil {
+		t.Errorf("Remove failed. Error = %v, Output = %s", err, out)
+	}
+
+	if out, err := run("install", "example/loop"); err != ErrArgument || !strings.Contains(out, "cycle") {
+		t.Errorf("Dependency cycle is not detected. Error = %v, Output = %s", err, out)
+	}
+}
+
+// A package which another package in parallel depends on by its manifest is installed only once
+func TestParallelDependenciesWithFakeGit(t *testing.T) {
+	cfg, fake, _ := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/app.git": {
+			Branch: "main", Commit: "6666666",
+			Files: map[string]string{config.ManifestFileName: "depends:\n  - example/lib\n"},
+		},
+		"https://github.com/example/lib.git": {
+			Branch: "main", Commit: "7777777", Delay: 200 * time.Millisecond,
+		},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	cfgFile := filepath.Join(dir, "config.yml")
+	err := ioutil.WriteFile(cfgFile, []byte("packages:\n- from: example/app\n- from: example/lib\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &strings.Builder{}
+	ctl := NewCli("0.0.1", cfg, fake, out, out)
+	if err := ctl.ParseAndExec([]string{"shelp", "bundle", "-c", cfgFile, "-j", "2"}); err != nil {
+		t.Errorf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	for _, pkg := range []string{"app", "lib"} {
+		if _, ok := loadReceipt(cfg, pkg); !ok {
+			t.Errorf("%s is not installed. Output = %s", pkg, out)
+		}
+	}
+}
+
+// Claims of packages are not shared by installations of different invocations
+func TestInstallSessionClaims(t *testing.T) {
+	first, second := newInstallSession(), newInstallSession()
+	release, err := first.claim(nil, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	done := make(chan error)
+	go func() {
+		release, err := second.claim(nil, "foo", nil)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Claim failed. Error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Claim in another session waits for the first one")
+	}
+}
+
+// Bundle writes lock file, and installs the locked commits with --frozen
+func TestLockFileWithFakeGit(t *testing.T) {
+	const fooURL = "https://github.com/example/foo.git"
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		fooURL: {Branch: "main", Commit: "1111111"},
+		"https://github.com/example/bar.git": {
+			Branch: "main", Commit: "2222222", Tags: map[string]string{"v1": "2000000"},
+		},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+	cfgFile := filepath.Join(dir, "config.yml")
+	lockFile := filepath.Join(dir, config.LockFileName)
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(cfgFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const configured = "packages:\n- from: example/foo\n- from: example/bar\n  at: v1\n"
+	writeConfig(configured)
+	if out, err := run("bundle", "-c", cfgFile, "--frozen"); err != ErrConfig ||
+		!strings.Contains(out, "Can't load lock file") {
+		t.Errorf("Bundle without lock file is frozen. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("bundle", "-c", cfgFile); err != nil {
+		t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	lock, err := config.LoadLock(lockFile)
+	if err != nil {
+		t.Fatalf("Can't load lock file. Error = %v", err)
+	}
+	want := []config.LockedPackage{
+		{Name: "foo", From: "example/foo", URL: fooURL, Ref: "main", Commit: "1111111"},
+		{
+			Name: "bar", From: "example/bar", At: "v1", URL: "https://github.com/example/bar.git",
+			Ref: "v1", Commit: "2000000",
+		},
+	}
+	if !reflect.DeepEqual(lock.Packages, want) {
+		t.Errorf("Unexpected lock: %+v", lock.Packages)
+	}
+	locked, _ := ioutil.ReadFile(lockFile)
+
+	// Locked commit is installed even if the branch is updated
+	fake.repos[fooURL] = fakeRepo{Branch: "main", Commit: "1212121"}
+	if out, err := run("remove", "foo"); err != nil {
+		t.Fatalf("Remove failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("bundle", "-c", cfgFile, "--frozen"); err != nil {
+		t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	if rc, ok := loadReceipt(cfg, "foo"); !ok || rc.Commit != "1111111" {
+		t.Errorf("Locked commit is not installed: %+v", rc)
+	}
+	if data, _ := ioutil.ReadFile(lockFile); string(data) != string(locked) {
+		t.Errorf("Lock file is updated by frozen bundle: %s", data)
+	}
+
+	for _, tt := range []struct {
+		config, message string
+	}{
+		{configured + "- from: example/baz\n", "\"baz\" is not found in lock file"},
+		{"packages:\n- from: example/foo\n  at: dev\n- from: example/bar\n  at: v1\n",
+			"\"foo\" in config file and lock file disagree"},
+		{"packages:\n- from: example/foo\n", "\"bar\" in lock file is not configured"},
+	} {
+		writeConfig(tt.config)
+		if out, err := run("bundle", "-c", cfgFile, "--frozen"); err != ErrConfig ||
+			!strings.Contains(out, tt.message) {
+			t.Errorf("Unexpected result for config:\n%s\nError = %v, Output = %s", tt.config, err, out)
+		}
+	}
+}
+
+// Dependencies which are not configured are locked, and installed at locked commits with --frozen
+func TestLockDependenciesWithFakeGit(t *testing.T) {
+	const (
+		libURL  = "https://github.com/example/lib.git"
+		utilURL = "https://github.com/example/util.git"
+	)
+	libManifest := map[string]string{config.ManifestFileName: "depends:\n  - example/util\n"}
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/app.git": {
+			Branch: "main", Commit: "6666666",
+			Files: map[string]string{config.ManifestFileName: "depends:\n  - example/lib\n"},
+		},
+		libURL:  {Branch: "main", Commit: "7777777", Files: libManifest},
+		utilURL: {Branch: "main", Commit: "8888888"},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+	cfgFile := filepath.Join(dir, "config.yml")
+	lockFile := filepath.Join(dir, config.LockFileName)
+	err := ioutil.WriteFile(cfgFile, []byte("packages:\n- from: example/app\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := run("bundle", "-c", cfgFile); err != nil {
+		t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	lock, err := config.LoadLock(lockFile)
+	if err != nil {
+		t.Fatalf("Can't load lock file. Error = %v", err)
+	}
+	want := []config.LockedPackage{
+		{
+			Name: "app", From: "example/app", URL: "https://github.com/example/app.git",
+			Ref: "main", Commit: "6666666",
+		},
+		{
+			Name: "lib", From: "example/lib", URL: libURL, Ref: "main", Commit: "7777777",
+			Dependency: true,
+		},
+		{
+			Name: "util", From: "example/util", URL: utilURL, Ref: "main", Commit: "8888888",
+			Dependency: true,
+		},
+	}
+	if !reflect.DeepEqual(lock.Packages, want) {
+		t.Errorf("Unexpected lock: %+v", lock.Packages)
+	}
+
+	// Dependencies are locked even if the dependent is up to date
+	if out, err := run("bundle", "-c", cfgFile); err != nil {
+		t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	if again, _ := config.LoadLock(lockFile); !reflect.DeepEqual(again.Packages, want) {
+		t.Errorf("Unexpected lock: %+v", again.Packages)
+	}
+
+	fake.repos[libURL] = fakeRepo{Branch: "main", Commit: "7070707", Files: libManifest}
+	fake.repos[utilURL] = fakeRepo{Branch: "main", Commit: "8080808"}
+	if out, err := run("upgrade"); err != nil {
+		t.Fatalf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("bundle", "-c", cfgFile, "--frozen"); err != nil {
+		t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	for name, commit := range map[string]string{"lib": "7777777", "util": "8888888"} {
+		if rc, ok := loadReceipt(cfg, name); !ok || rc.Commit != commit {
+			t.Errorf("Locked commit of %s is not installed: %+v", name, rc)
+		}
+	}
+
+	lock.Packages = lock.Packages[:2]
+	if err = lock.Save(lockFile); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("remove", "--force", "lib", "util"); err != nil {
+		t.Fatalf("Remove failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("bundle", "-c", cfgFile, "--frozen"); err == nil ||
+		!strings.Contains(out, "Dependency \"util\" of \"lib\" is not found in lock file") {
+		t.Errorf("Unlocked dependency is installed. Error = %v, Output = %s", err, out)
+	}
+}
+
+// Packages with local changes are skipped by upgrade and bundle unless strategy is specified
+func TestLocalChangesWithFakeGit(t *testing.T) {
+	const url = "https://github.com/example/quux.git"
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{url: {Branch: "main", Commit: "aaaaaaa"}})
+	dir := filepath.Dir(cfg.RootPath())
+
+	cfgFile := filepath.Join(dir, "config.yml")
+	err := ioutil.WriteFile(cfgFile, []byte("packages:\n- from: example/quux\n  at: dev\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modify := func(changes []string, unpushed int) {
+		path := filepath.Join(cfg.PackagePath(), "quux")
+		wt, err := fake.load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wt.Changes, wt.Unpushed = changes, unpushed
+		if err = fake.save(path, wt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := run("install", "example/quux"); err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("status"); err != nil || out != "No package has local changes\n" {
+		t.Errorf("Unexpected status result. Error = %v, Output = %s", err, out)
+	}
+	modify([]string{"README.md"}, 1)
+	if out, err := run("status"); err != nil || !strings.HasPrefix(out, "quux\t1 changed files") {
+		t.Errorf("Unexpected status result. Error = %v, Output = %s", err, out)
+	}
+
+	fake.repos[url] = fakeRepo{Branch: "main", Commit: "bbbbbbb"}
+	if out, err := run("upgrade"); err != ErrWarning || !strings.Contains(out, "Skip \"quux\"") {
+		t.Errorf("Package with local changes is upgraded. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade", "--stash", "quux"); err != ErrLocalChanges {
+		t.Errorf("Unpushed commits are stashed. Error = %v, Output = %s", err, out)
+	}
+	modify([]string{"README.md"}, 0)
+	if out, err := run("upgrade", "--stash", "quux"); err != nil {
+		t.Errorf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	if rc, ok := loadReceipt(cfg, "quux"); !ok || rc.Commit != "bbbbbbb" {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+
+	// Backend without stash leaves the changes in the previous generation
+	fake.noStash = true
+	modify([]string{"README.md"}, 0)
+	fake.repos[url] = fakeRepo{Branch: "main", Commit: "ccccccc"}
+	if out, err := run("upgrade", "--stash", "quux"); err != nil ||
+		!strings.Contains(out, "left in the previous generation") {
+		t.Errorf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	current, _ := currentGeneration(cfg)
+	prev, err := fake.load(filepath.Join(generationDir(cfg, current-1), "packages", "quux"))
+	if err != nil || len(prev.Changes) != 1 {
+		t.Errorf("Changes are not left in the previous generation: %+v. Error = %v", prev, err)
+	}
+	if st, _ := fake.Status(filepath.Join(cfg.PackagePath(), "quux"), false); !st.IsClean() {
+		t.Errorf("Changes are left in the current generation: %+v", st)
+	}
+	fake.noStash = false
+
+	modify([]string{"README.md"}, 0)
+	if out, err := run("bundle", "-c", cfgFile); err != ErrOperationFailed ||
+		!strings.Contains(out, statusSkipped) {
+		t.Errorf("Package with local changes is re-installed. Error = %v, Output = %s", err, out)
+	}
+	lockFile := filepath.Join(dir, config.LockFileName)
+	if lock, _ := config.LoadLock(lockFile); len(lock.Packages) > 0 {
+		t.Errorf("Skipped package is locked: %+v", lock)
+	}
+	modify([]string{"README.md"}, 1)
+	if out, err := run("bundle", "-c", cfgFile, "--stash"); err != ErrOperationFailed {
+		t.Errorf("Unpushed commits are stashed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("bundle", "-c", cfgFile, "--force"); err != nil {
+		t.Errorf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	if rc, ok := loadReceipt(cfg, "quux"); !ok || rc.Ref != "dev" {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+
+	err = ioutil.WriteFile(cfgFile, []byte("packages:\n- from: example/quux\n  at: main\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify([]string{"README.md"}, 0)
+	if out, err := run("bundle", "-c", cfgFile); err != ErrOperationFailed {
+		t.Errorf("Package with local changes is re-installed. Error = %v, Output = %s", err, out)
+	}
+	if lock, _ := config.LoadLock(lockFile); len(lock.Packages) != 1 || lock.Packages[0].At != "dev" {
+		t.Errorf("Lock of skipped package is updated: %+v", lock)
+	}
+	out, err := run("bundle", "-c", cfgFile, "--stash")
+	if err != nil || !strings.Contains(out, "left in the previous generation") {
+		t.Errorf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	if lock, _ := config.LoadLock(lockFile); len(lock.Packages) != 1 || lock.Packages[0].At != "main" {
+		t.Errorf("Unexpected lock: %+v", lock)
+	}
+}
+
+// Roll back a package after upgrade, then upgrade it again
+func TestRollbackWithFakeGit(t *testing.T) {
+	const url = "https://github.com/example/corge.git"
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		url: {Branch: "main", Commit: "c0c0c0c", Bins: []string{"corge"}},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	if out, err := run("install", "example/corge"); err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("rollback", "corge"); err != ErrArgument {
+		t.Errorf("Package without history is rolled back. Error = %v, Output = %s", err, out)
+	}
+
+	fake.repos[url] = fakeRepo{Branch: "main", Commit: "c1c1c1c", Bins: []string{"corge"}}
+	if out, err := run("upgrade", "corge"); err != nil {
+		t.Fatalf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("rollback", "corge", "--to", "2"); err != ErrArgument {
+		t.Errorf("Rollback beyond history succeeded. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("rollback", "corge"); err != nil {
+		t.Errorf("Rollback failed. Error = %v, Output = %s", err, out)
+	}
+	rc, ok := loadReceipt(cfg, "corge")
+	if !ok || rc.Commit != "c0c0c0c" || rc.Pin == nil || rc.Pin.Ref != "main" ||
+		len(rc.History) != 1 || rc.History[0].Commit != "c1c1c1c" {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+	if _, err := os.Readlink(filepath.Join(cfg.BinPath(), "corge")); err != nil {
+		t.Errorf("Bin is not linked after rollback. Error = %v", err)
+	}
+
+	if out, err := run("outdated"); err != nil || out != "corge (rolled back to c0c0c0c)\n" {
+		t.Errorf("Unexpected outdated result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("info", "corge"); err != nil || !strings.Contains(out, "from c1c1c1c") {
+		t.Errorf("Unexpected info result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade"); err != nil || !strings.Contains(out, "Skip \"corge\"") {
+		t.Errorf("Rolled back package is upgraded. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade", "corge"); err != nil {
+		t.Errorf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	if rc, ok := loadReceipt(cfg, "corge"); !ok || rc.Commit != "c1c1c1c" || rc.Pin != nil {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+
+	// Package rolled back from a tag returns to the tag
+	fake.repos[url] = fakeRepo{
+		Branch: "main", Commit: "c1c1c1c", Tags: map[string]string{"v1": "c0c0c0c", "v2": "c2c2c2c"},
+	}
+	cfgFile := filepath.Join(dir, "config.yml")
+	for _, tag := range []string{"v1", "v2"} {
+		conf := "packages:\n- from: example/corge\n  as: corge-tag\n  at: " + tag + "\n"
+		if err := ioutil.WriteFile(cfgFile, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := run("bundle", "-c", cfgFile); err != nil {
+			t.Fatalf("Bundle failed. Error = %v, Output = %s", err, out)
+		}
+	}
+	if out, err := run("rollback", "corge-tag"); err != nil {
+		t.Errorf("Rollback failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade", "corge-tag"); err != nil {
+		t.Errorf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	rc, ok = loadReceipt(cfg, "corge-tag")
+	if !ok || rc.Commit != "c2c2c2c" || rc.Ref != "v2" || rc.Pin != nil {
+		t.Errorf("Unexpected receipt: %+v", rc)
+	}
+}
+
+// Upgrade builds a new generation, and rollback switches back to an older one
+func TestGenerationsWithFakeGit(t *testing.T) {
+	const url = "https://github.com/example/grault.git"
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		url: {Branch: "main", Commit: "d0d0d0d", Bins: []string{"grault"}},
+	})
+
+	commit := func() string {
+		rc, _ := loadReceipt(cfg, "grault")
+		return rc.Commit
+	}
+
+	if out, err := run("install", "example/grault"); err != nil {
+		t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("upgrade"); err != nil || strings.Contains(out, "Switched") {
+		t.Errorf("Generation is made without change. Error = %v, Output = %s", err, out)
+	}
+	fake.repos[url] = fakeRepo{Branch: "main", Commit: "d1d1d1d", Bins: []string{"grault"}}
+	if out, err := run("upgrade"); err != nil || !strings.Contains(out, "Switched to generation 2") {
+		t.Errorf("Unexpected upgrade result. Error = %v, Output = %s", err, out)
+	}
+	if current, _ := currentGeneration(cfg); current != 2 || commit() != "d1d1d1d" {
+		t.Errorf("Unexpected generation: %d, commit = %s", current, commit())
+	}
+	// Files hard-linked between generations are copied before upgrade
+	prev, err := fake.load(filepath.Join(generationDir(cfg, 1), "packages", "grault"))
+	if err != nil || prev.Commit != "d0d0d0d" {
+		t.Errorf("Previous generation is changed: %+v. Error = %v", prev, err)
+	}
+	link, err := os.Readlink(filepath.Join(cfg.ShellBinPath(), "grault"))
+	if err != nil || !strings.HasPrefix(link, generationDir(cfg, 2)) {
+		t.Errorf("Unexpected link: %s. Error = %v", link, err)
+	}
+
+	if out, err := run("upgrade", "no-such-package"); err != ErrArgument {
+		t.Errorf("Unexpected upgrade result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("generations"); err != nil || !strings.Contains(out, "*   2") ||
+		!strings.Contains(out, "migrate") || strings.Contains(out, "  3  ") {
+		t.Errorf("Unexpected generations result. Error = %v, Output = %s", err, out)
+	}
+
+	if out, err := run("rollback", "--generation", "1"); err != nil {
+		t.Errorf("Rollback failed. Error = %v, Output = %s", err, out)
+	}
+	if current, _ := currentGeneration(cfg); current != 1 || commit() != "d0d0d0d" {
+		t.Errorf("Unexpected generation: %d, commit = %s", current, commit())
+	}
+	if out, err := run("rollback", "--generation", "9"); err != ErrArgument {
+		t.Errorf("Switched to missing generation. Error = %v, Output = %s", err, out)
+	}
+}
+
+func TestRootLockWithFakeGit(t *testing.T) {
+	const url = "https://github.com/example/garply.git"
+	cfg, _, run := newFakeEnv(t, map[string]fakeRepo{
+		url: {Branch: "main", Commit: "e0e0e0e", Bins: []string{"garply"}},
+	})
+
+	holder := commonCmd{config: cfg, outs: ioutil.Discard, errs: ioutil.Discard}
+
+	unlock, err := lockRootFor(&holder, true, 0)
+	if err != nil {
+		t.Fatalf("Lock failed. Error = %v", err)
+	}
+	if out, err := run("list"); err != ErrLocked || !strings.Contains(out, "--wait") {
+		t.Errorf("Unexpected list result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("install", "--wait", "300ms", "example/garply"); err != ErrLocked ||
+		!strings.Contains(out, "Waiting for pid") {
+		t.Errorf("Unexpected install result. Error = %v, Output = %s", err, out)
+	}
+	unlock()
+
+	unlock, err = lockRootFor(&holder, false, 0)
+	if err != nil {
+		t.Fatalf("Lock failed. Error = %v", err)
+	}
+	if out, err := run("list"); err != nil {
+		t.Errorf("List failed under shared lock. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("install", "example/garply"); err != ErrLocked {
+		t.Errorf("Unexpected install result. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("install", "--dry-run", "example/garply"); err != nil {
+		t.Errorf("Dry run failed under shared lock. Error = %v, Output = %s", err, out)
+	}
+	unlock()
+
+	if out, err := run("install", "example/garply"); err != nil {
+		t.Errorf("Install failed. Error = %v, Output = %s", err, out)
+	}
+
+	// Pid file left by dead process is stale
+	lock := &rootLock{path: cfg.RootLockFile(), exclusive: true}
+	lock.pidFile = lock.path + ".pid"
+	if err = ioutil.WriteFile(lock.pidFile, []byte("99999999\nshelp sync\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if holder, err := lock.tryLock(); holder != nil || err != nil {
+		t.Errorf("Stale pid file is not taken over. Holder = %v, Error = %v", holder, err)
+	}
+	other := &rootLock{path: lock.path, exclusive: false, pidFile: lock.pidFile}
+	if holder, err := other.tryLock(); holder == nil || holder.pid != os.Getpid() {
+		t.Errorf("Unexpected lock holder: %v. Error = %v", holder, err)
+	}
+	lock.unlock()
+	if _, err = os.Stat(lock.pidFile); !os.IsNotExist(err) {
+		t.Errorf("Pid file is not removed. Error = %v", err)
+	}
+}
+
+func TestInterruptWithFakeGit(t *testing.T) {
+	cfg, fake, _ := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/waldo.git": {Branch: "main", Commit: "f0f0f0f"},
+		"https://github.com/example/fred.git":  {Branch: "main", Commit: "f1f1f1f"},
+	})
+	dir := filepath.Dir(cfg.RootPath())
+
+	cfgFile := filepath.Join(dir, "config.yml")
+	err := ioutil.WriteFile(cfgFile, []byte(`packages:
+- from: example/waldo
+- from: example/fred
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.onClone = cancel
+	out := &strings.Builder{}
+	ctl := NewCli("0.0.1", cfg, fake, out, out)
+	ctl.ctx = ctx
+	err = ctl.ParseAndExec([]string{"shelp", "bundle", "-c", cfgFile})
+	if err != ErrInterrupted || !strings.Contains(out.String(), "is discarded") {
+		t.Errorf("Unexpected bundle result. Error = %v, Output = %s", err, out)
+	}
+	if files, _ := ioutil.ReadDir(cfg.TempPath()); len(files) > 0 {
+		t.Errorf("Temporary files are left: %v", files)
+	}
+	if _, ok := currentGeneration(cfg); ok {
+		t.Errorf("Generation is switched by interrupted bundle")
+	}
+	if _, err = os.Stat(cfg.LockFile()); !os.IsNotExist(err) {
+		t.Errorf("Lock file is written by interrupted bundle. Error = %v", err)
+	}
+
+	// Files left by killed process are removed on next run
+	fake.onClone = nil
+	partial := filepath.Join(cfg.TempPath(), "waldo")
+	building := generationDir(cfg, 7)
+	for _, dir := range []string{partial, building} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(building, generationBuildingFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out = &strings.Builder{}
+	ctl = NewCli("0.0.1", cfg, fake, out, out)
+	if err = ctl.ParseAndExec([]string{"shelp", "bundle", "-c", cfgFile}); err != nil {
+		t.Errorf("Bundle failed. Error = %v, Output = %s", err, out)
+	}
+	for _, dir := range []string{partial, building} {
+		if _, err = os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Stale directory is not removed: %s. Error = %v", dir, err)
+		}
+	}
+	if !strings.Contains(out.String(), "left by interrupted shelp") {
+		t.Errorf("Removal of stale files is not reported. Output = %s", out)
+	}
+}
+
+// Prompt to confirm is abandoned by interruption, and later input doesn't proceed
+func TestConfirmInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := &commonCmd{outs: ioutil.Discard, ctx: ctx}
+	in, w := io.Pipe()
+	defer w.Close()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if ok, err := confirm(cmd, in); ok || err != ErrInterrupted {
+		t.Errorf("Unexpected result of interrupted prompt. OK = %v, Error = %v", ok, err)
+	}
+
+	cmd.ctx = context.Background()
+	for input, want := range map[string]bool{"\n": true, "y\n": true, "n\n": false, "No\n": false} {
+		if ok, err := confirm(cmd, strings.NewReader(input)); ok != want || err != nil {
+			t.Errorf("Unexpected answer to %q. OK = %v, Error = %v", input, ok, err)
+		}
+	}
+}
+
+func TestRetryWithFakeGit(t *testing.T) {
+	cfg, fake, _ := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/plugh.git": {Branch: "main", Commit: "a0a0a0a"},
+	})
+	fake.cloneErrors = make(chan error, 3)
+
+	run := func(policy git.Policy, args ...string) (string, error) {
+		out := &strings.Builder{}
+		backend := git.WithPolicy(fake, policy, out)
+		ctl := NewCli("0.0.1", cfg, backend, out, out)
+		err := ctl.ParseAndExec(append([]string{"shelp"}, args...))
+		return out.String(), err
+	}
+	policy := git.Policy{Retries: 2, Backoff: time.Millisecond}
+
+	fake.cloneErrors <- errors.New("fatal: unable to access: Could not resolve host: github.com")
+	fake.cloneErrors <- errors.New("fatal: the remote end hung up unexpectedly")
+	out, err := run(policy, "install", "example/plugh")
+	if err != nil || strings.Count(out, "Retry in") != 2 {
+		t.Errorf("Unexpected install result. Error = %v, Output = %s", err, out)
+	}
+
+	fake.cloneErrors <- errors.New("remote: Repository not found")
+	out, err = run(policy, "install", "example/plugh", "thud")
+	if err != ErrCommandFailed || strings.Contains(out, "Retry in") {
+		t.Errorf("Permanent error is retried. Error = %v, Output = %s", err, out)
+	}
+
+	fake.cloneDelay = time.Second
+	policy.Timeout = 20 * time.Millisecond
+	out, err = run(policy, "install", "example/plugh", "thud")
+	if err != ErrCommandFailed || strings.Count(out, "Retry in") != 2 ||
+		!strings.Contains(out, "timed out after 20ms") {
+		t.Errorf("Unexpected install result on timeout. Error = %v, Output = %s", err, out)
+	}
+}
+
+func TestOutdatedCacheWithFakeGit(t *testing.T) {
+	cfg, fake, run := newFakeEnv(t, map[string]fakeRepo{
+		"https://github.com/example/xyzzy.git": {Branch: "main", Commit: "b0b0b0b"},
+		"https://github.com/example/quux.git":  {Branch: "main", Commit: "c0c0c0c"},
+	})
+
+	for _, pkg := range []string{"example/xyzzy", "example/quux"} {
+		if out, err := run("install", pkg); err != nil {
+			t.Fatalf("Install failed. Error = %v, Output = %s", err, out)
+		}
+	}
+	if out, err := run("outdated"); err != nil || out != "" {
+		t.Errorf("Unexpected outdated result. Error = %v, Output = %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CachePath(), updateCacheFile)); err != nil {
+		t.Errorf("Results are not cached. Error = %v", err)
+	}
+
+	fake.repos["https://github.com/example/quux.git"] = fakeRepo{Branch: "main", Commit: "c1c1c1c"}
+	if out, err := run("outdated"); err != nil || out != "" {
+		t.Errorf("Cached result is not used. Error = %v, Output = %s", err, out)
+	}
+	cfg.Outdated.TTL = -1
+	if out, err := run("outdated"); err != nil || out != "quux\n" {
+		t.Errorf("Cache is not disabled. Error = %v, Output = %s", err, out)
+	}
+	cfg.Outdated.TTL = 0
+	fake.repos["https://github.com/example/xyzzy.git"] = fakeRepo{Branch: "main", Commit: "b1b1b1b"}
+	if out, err := run("outdated"); err != nil || out != "quux\n" {
+		t.Errorf("Cached result is not used. Error = %v, Output = %s", err, out)
+	}
+	if out, err := run("outdated", "--refresh"); err != nil || out != "quux\nxyzzy\n" {
+		t.Errorf("Cache is not ignored by refresh. Error = %v, Output = %s", err, out)
+	}
+
+	// Dry-run doesn't write cache
+	cache := filepath.Join(cfg.CachePath(), updateCacheFile)
+	if err := os.Remove(cache); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("upgrade", "--dry-run"); err != nil {
+		t.Errorf("Upgrade failed. Error = %v, Output = %s", err, out)
+	}
+	if _, err := os.Stat(cache); !os.IsNotExist(err) {
+		t.Errorf("Results are cached by dry-run. Error = %v", err)
+	}
+
+	// Upgrade doesn't trust cache, and result of upgraded package is no longer valid. Each package
+	// is checked once
+	var calls int32
+	fake.remoteCalls = &calls
+	if out, err := run("upgrade"); err != nil || !strings.Contains(out, "2 packages upgraded") {
+		t.Errorf("Unexpected upgrade result. Error = %v, Output = %s", err, out)
+	}
+	if calls != 2 {
+		t.Errorf("Remote is queried %d times for 2 packages", calls)
+	}
+	if out, err := run("outdated"); err != nil || out != "" {
+		t.Errorf("Unexpected outdated result. Error = %v, Output = %s", err, out)
+	}
+
+	// Local branch is compared with its upstream branch
+	const url = "https://github.com/example/xyzzy.git"
+	fake.repos[url] = fakeRepo{
+		Branch: "main", Commit: "b1b1b1b", Heads: map[string]string{"release": "b2b2b2b"},
+	}
+	path := filepath.Join(cfg.PackagePath(), "xyzzy")
+	wt, err := fake.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.Branch, wt.Upstream, wt.Commit = "local", "release", "b2b2b2b"
+	if err = fake.save(path, wt); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("outdated", "--refresh"); err != nil || out != "" {
+		t.Errorf("Branch is not compared with upstream. Error = %v, Output = %s", err, out)
+	}
+
+	// Sync checks updates in the same way, and caches results
+	cfgFile := filepath.Join(filepath.Dir(cfg.RootPath()), "config.yml")
+	err = ioutil.WriteFile(cfgFile, []byte("packages:\n- from: example/quux\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(cache); err != nil {
+		t.Fatal(err)
+	}
+	fake.repos["https://github.com/example/quux.git"] = fakeRepo{Branch: "main", Commit: "c2c2c2c"}
+	calls = 0
+	if out, err := run("sync", "-c", cfgFile, "--dry-run"); err != nil ||
+		!strings.Contains(out, "quux (upgrade)") || calls != 1 {
+		t.Errorf("Unexpected sync plan. Calls = %d, Error = %v, Output = %s", calls, err, out)
+	}
+	if out, err := run("sync", "-c", cfgFile, "--yes"); err != nil {
+		t.Errorf("Sync failed. Error = %v, Output = %s", err, out)
+	}
+	if _, err := os.Stat(cache); err != nil {
+		t.Errorf("Results are not cached by sync. Error = %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/progrhyme/shelp/internal/config"
+)
+
+// defaultGenerationsToKeep is the number of generations kept when "generations.keep" is not set
+const defaultGenerationsToKeep = 10
+
+// generationMetaFile records how a generation is made
+const generationMetaFile = "generation.json"
+
+// generationBuildingFile marks a generation being built. It is left when shelp is killed
+const generationBuildingFile = ".building"
+
+// generationDirs are directories in a generation. Each of them is linked from the root directory
+// through "current" symlink
+var generationDirs = []string{"packages", "bin", "receipts", "share"}
+
+// generation is a snapshot of packages, executables and receipts
+type generation struct {
+	Number    int       `json:"number"`
+	Command   string    `json:"command"`
+	CreatedAt time.Time `json:"created_at"`
+	Packages  int       `json:"packages"`
+	Current   bool      `json:"current"`
+	dir       string
+}
+
+func generationDir(cfg *config.Config, number int) string {
+	return filepath.Join(cfg.GenerationPath(), strconv.Itoa(number))
+}
+
+// currentGeneration returns number of the current generation. It returns false when generations
+// are not introduced yet
+func currentGeneration(cfg *config.Config) (int, bool) {
+	target, err := os.Readlink(cfg.CurrentLink())
+	if err != nil {
+		return 0, false
+	}
+	number, err := strconv.Atoi(filepath.Base(target))
+	return number, err == nil
+}
+
+// listGenerations returns existing generations in ascending order
+func listGenerations(cfg *config.Config) ([]generation, error) {
+	gens := []generation{}
+	files, err := ioutil.ReadDir(cfg.GenerationPath())
+	if os.IsNotExist(err) {
+		return gens, nil
+	}
+	if err != nil {
+		return gens, err
+	}
+
+	current, _ := currentGeneration(cfg)
+	for _, file := range files {
+		number, err := strconv.Atoi(file.Name())
+		if err != nil || !file.IsDir() {
+			continue
+		}
+		gen := generation{Number: number, CreatedAt: file.ModTime()}
+		gen.dir = generationDir(cfg, number)
+		if data, err := ioutil.ReadFile(filepath.Join(gen.dir, generationMetaFile)); err == nil {
+			json.Unmarshal(data, &gen)
+		}
+		if pkgs, err := ioutil.ReadDir(filepath.Join(gen.dir, "packages")); err == nil {
+			gen.Packages = len(pkgs)
+		}
+		gen.Current = number == current
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].Number < gens[j].Number })
+	return gens, nil
+}
+
+func (gen *generation) save() error {
+	data, err := json.MarshalIndent(gen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(gen.dir, generationMetaFile), append(data, '\n'), 0644)
+}
+
+// inGeneration runs operations in a new generation copied from the current one, and switches to
+// it when they succeed. The current generation is kept intact when they fail. Only bundle, sync
+// and upgrade use it; other commands change the current generation in place
+func inGeneration(cmd verboseRunner, command string, run func() error) error {
+	if isDryRun(cmd) {
+		return run()
+	}
+	gen, err := beginGeneration(cmd, command)
+	if err != nil {
+		return err
+	}
+	return finishGeneration(cmd, gen, run())
+}
+
+func beginGeneration(cmd verboseRunner, command string) (generation, error) {
+	cfg := cmd.getConfig()
+	gen := generation{Command: command}
+	if err := migrateLayout(cmd); err != nil {
+		return gen, err
+	}
+
+	gens, err := listGenerations(cfg)
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't read generations. Error = %v\n", err)
+		return gen, ErrOperationFailed
+	}
+	gen.Number = 1
+	if len(gens) > 0 {
+		gen.Number = gens[len(gens)-1].Number + 1
+	}
+	gen.dir = generationDir(cfg, gen.Number)
+	gen.CreatedAt = time.Now()
+
+	if current, ok := currentGeneration(cfg); ok {
+		err = copyGeneration(generationDir(cfg, current), gen.dir)
+	} else {
+		err = os.MkdirAll(gen.dir, 0755)
+	}
+	if err == nil {
+		err = gen.save()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(gen.dir, generationBuildingFile), nil, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(
+			cmd.getErrs(), "Error! Can't create generation %d. Error = %v\n", gen.Number, err)
+		os.RemoveAll(gen.dir)
+		return gen, ErrOperationFailed
+	}
+	if *cmd.getVerboseOpts().getVerbose() {
+		fmt.Fprintf(cmd.getErrs(), "[Info] Build generation %d in %s\n", gen.Number, gen.dir)
+	}
+	cfg.SetGeneration(gen.dir)
+	return gen, nil
+}
+
+func finishGeneration(cmd verboseRunner, gen generation, result error) error {
+	cfg := cmd.getConfig()
+	cfg.SetGeneration("")
+
+	if result != nil && interrupted(cmd) {
+		result = ErrInterrupted
+	}
+	if result != nil && result != ErrWarning {
+		os.RemoveAll(gen.dir)
+		fmt.Fprintf(
+			cmd.getErrs(), "Generation %d is discarded. Installed packages are unchanged\n",
+			gen.Number)
+		return result
+	}
+	if current, ok := currentGeneration(cfg); ok {
+		if generationDigest(generationDir(cfg, current)) == generationDigest(gen.dir) {
+			// Nothing is changed
+			os.RemoveAll(gen.dir)
+			return result
+		}
+	}
+
+	err := os.Remove(filepath.Join(gen.dir, generationBuildingFile))
+	if err == nil {
+		err = switchGeneration(cfg, gen.Number)
+	}
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't switch generation. Error = %v\n", err)
+		return ErrOperationFailed
+	}
+	fmt.Fprintf(cmd.getOuts(), "Switched to generation %d\n", gen.Number)
+	removeOldGenerations(cmd)
+	return result
+}
+
+// switchGeneration flips "current" symlink to the generation atomically
+func switchGeneration(cfg *config.Config, number int) error {
+	link := cfg.CurrentLink()
+	tmp := link + ".new"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("generations", strconv.Itoa(number)), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		return err
+	}
+
+	for _, dir := range generationDirs {
+		path := filepath.Join(cfg.RootPath(), dir)
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			if err = os.Symlink(filepath.Join("current", dir), path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLayout moves packages installed before generations are introduced into the first one
+func migrateLayout(cmd verboseRunner) error {
+	cfg := cmd.getConfig()
+	if _, ok := currentGeneration(cfg); ok {
+		return nil
+	}
+	legacy := filepath.Join(cfg.RootPath(), "packages")
+	if fi, err := os.Lstat(legacy); err != nil || !fi.IsDir() {
+		return nil
+	}
+
+	gen := generation{Number: 1, Command: "migrate", CreatedAt: time.Now()}
+	gen.dir = generationDir(cfg, gen.Number)
+	fail := func(err error) error {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't migrate to generations. Error = %v\n", err)
+		return ErrOperationFailed
+	}
+	if err := os.MkdirAll(gen.dir, 0755); err != nil {
+		return fail(err)
+	}
+	for _, dir := range generationDirs {
+		src, dst := filepath.Join(cfg.RootPath(), dir), filepath.Join(gen.dir, dir)
+		var err error
+		if _, err = os.Stat(src); os.IsNotExist(err) {
+			err = os.MkdirAll(dst, 0755)
+		} else {
+			err = os.Rename(src, dst)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := retargetLinks(filepath.Join(gen.dir, "bin"), cfg.RootPath(), gen.dir); err != nil {
+		return fail(err)
+	}
+	if err := gen.save(); err != nil {
+		return fail(err)
+	}
+	if err := switchGeneration(cfg, gen.Number); err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(cmd.getErrs(), "Migrated installed packages into generation %d\n", gen.Number)
+	return nil
+}
+
+// retargetLinks changes targets of symlinks in the directory from under "from" to under "to"
+func retargetLinks(dir, from, to string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		target, err := os.Readlink(path)
+		if err != nil || !strings.HasPrefix(target, from+string(filepath.Separator)) {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		if err = os.Symlink(to+strings.TrimPrefix(target, from), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyGeneration copies contents of a generation. Symlinks into the source generation are
+// retargeted to the copy. Files of packages are hard-linked, and detachPackage copies them only
+// when the package is modified. Git objects are never modified, so they stay hard-linked
+func copyGeneration(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == generationMetaFile || rel == generationBuildingFile {
+			return err
+		}
+		to := filepath.Join(dst, rel)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(target, src+string(filepath.Separator)) {
+				target = dst + strings.TrimPrefix(target, src)
+			}
+			return os.Symlink(target, to)
+		case fi.IsDir():
+			return os.MkdirAll(to, fi.Mode().Perm())
+		case strings.HasPrefix(rel, "packages"+string(filepath.Separator)):
+			if err := os.Link(path, to); err == nil {
+				return nil
+			}
+		}
+		return copyFile(path, to, fi.Mode().Perm())
+	})
+}
+
+// detachPackage replaces files of a package hard-linked with other generations by copies, so that
+// modifying its working tree in place doesn't change them. Git objects are left shared
+func detachPackage(cmd runner, name string) error {
+	cfg := cmd.getConfig()
+	if _, ok := currentGeneration(cfg); !ok {
+		return nil
+	}
+	pkgPath := filepath.Join(cfg.PackagePath(), name)
+	err := filepath.Walk(pkgPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(pkgPath, path)
+		if err != nil || isGitObject(string(filepath.Separator)+rel) {
+			return err
+		}
+		tmp := path + ".shelp-detach"
+		if err = copyFile(path, tmp, fi.Mode().Perm()); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, path)
+	})
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't copy files of \"%s\". Error = %v\n", name, err)
+		return ErrOperationFailed
+	}
+	return nil
+}
+
+func isGitObject(rel string) bool {
+	sep := string(filepath.Separator)
+	objects := sep + ".git" + sep + "objects" + sep
+	return strings.Contains(rel, objects) && filepath.Base(filepath.Dir(rel)) != "info"
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// generationDigest summarizes installed packages and executables in a generation to find changes
+func generationDigest(dir string) string {
+	lines := []string{}
+	if pkgs, err := ioutil.ReadDir(filepath.Join(dir, "packages")); err == nil {
+		for _, pkg := range pkgs {
+			line := "package " + pkg.Name()
+			if target, err := os.Readlink(filepath.Join(dir, "packages", pkg.Name())); err == nil {
+				line += " -> " + target
+			}
+			rc := receipt{}
+			data, err := ioutil.ReadFile(filepath.Join(dir, "receipts", pkg.Name()+".json"))
+			if err == nil && json.Unmarshal(data, &rc) == nil {
+				line += fmt.Sprintf(" %s %s", rc.Commit, rc.UpdatedAt.Format(time.RFC3339Nano))
+			}
+			lines = append(lines, line)
+		}
+	}
+	if bins, err := ioutil.ReadDir(filepath.Join(dir, "bin")); err == nil {
+		for _, bin := range bins {
+			target, _ := os.Readlink(filepath.Join(dir, "bin", bin.Name()))
+			lines = append(lines, fmt.Sprintf("bin %s -> %s", bin.Name(), strings.TrimPrefix(target, dir)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// removeOldGenerations deletes oldest generations except the current one beyond the limit
+func removeOldGenerations(cmd verboseRunner) {
+	cfg := cmd.getConfig()
+	keep := cfg.Generations.Keep
+	if keep <= 0 {
+		keep = defaultGenerationsToKeep
+	}
+	gens, err := listGenerations(cfg)
+	if err != nil {
+		return
+	}
+	remaining := len(gens)
+	for _, gen := range gens {
+		if remaining <= keep {
+			break
+		}
+		if gen.Current {
+			continue
+		}
+		if *cmd.getVerboseOpts().getVerbose() {
+			fmt.Fprintf(cmd.getErrs(), "[Info] Remove generation %d\n", gen.Number)
+		}
+		if err = os.RemoveAll(gen.dir); err != nil {
+			fmt.Fprintf(
+				cmd.getErrs(), "Warning! Can't remove generation %d. Error = %v\n", gen.Number, err)
+		}
+		remaining--
+	}
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+type generationsCmd struct {
+	verboseCmd
+}
+
+func newGenerationsCmd(common commonCmd) generationsCmd {
+	cmd := &generationsCmd{}
+	cmd.commonCmd = common
+	setupCmdFlags(cmd, "generations", cmd.usage)
+	setupOutputFlag(cmd)
+	return *cmd
+}
+
+func (cmd *generationsCmd) usage() {
+	const help = `Summary:
+  List generations of installed packages.
+
+Syntax:
+  {{.Prog}} {{.Cmd}}
+
+"bundle", "sync" and "upgrade" build a new generation of packages and executables, then switch to it
+at once when they succeed. The current generation is marked with "*".
+Other commands such as "install", "remove", "link", "prune" and "rollback" of a package change the
+current generation in place.
+To switch back to an older generation, run "{{.Prog}} rollback --generation <number>".
+
+Options:
+`
+
+	t := template.Must(template.New("usage").Parse(help))
+	t.Execute(cmd.errs, struct{ Prog, Cmd string }{cmd.name, "generations"})
+
+	cmd.flags.PrintDefaults()
+}
+
+func (cmd *generationsCmd) parseAndExec(args []string) error {
+	done, err := parseStart(cmd, args, false, false)
+	if done || err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cmd, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	gens, err := listGenerations(cmd.config)
+	if err != nil {
+		fmt.Fprintf(cmd.errs, "Error! Can't read generations. Error = %v\n", err)
+		return ErrOperationFailed
+	}
+
+	if isJSONOutput(cmd) {
+		data, err := json.MarshalIndent(gens, "", "  ")
+		if err != nil {
+			fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+			return ErrOperationFailed
+		}
+		fmt.Fprintln(cmd.outs, string(data))
+		return nil
+	}
+
+	if len(gens) == 0 {
+		fmt.Fprintln(cmd.errs, "No generation is created")
+		return nil
+	}
+	for _, gen := range gens {
+		mark := " "
+		if gen.Current {
+			mark = "*"
+		}
+		fmt.Fprintf(
+			cmd.outs, "%s %3d  %s  %-8s %d packages\n", mark, gen.Number,
+			gen.CreatedAt.Local().Format(time.RFC3339), gen.Command, gen.Packages)
+		if *cmd.option.verbose {
+			fmt.Fprintf(cmd.outs, "        %s\n", gen.dir)
+		}
+	}
+	return nil
+}
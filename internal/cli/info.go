@@ -0,0 +1,262 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/progrhyme/shelp/internal/git"
+)
+
+type infoCmd struct {
+	gitCmd
+}
+
+// packageInfo is details of an installed package
+type packageInfo struct {
+	Name          string    `json:"name"`
+	Path          string    `json:"path"`
+	Source        string    `json:"source"`
+	Configured    bool      `json:"configured"`
+	URL           string    `json:"url,omitempty"`
+	Branch        string    `json:"branch,omitempty"`
+	Tag           string    `json:"tag,omitempty"`
+	Constraint    string    `json:"constraint,omitempty"`
+	Commit        string    `json:"commit,omitempty"`
+	TracksDefault bool      `json:"tracks_default"`
+	Bins          []string  `json:"bins"`
+	Completions   []string  `json:"completions,omitempty"`
+	Man           []string  `json:"man,omitempty"`
+	SourceFiles   []string  `json:"source_files,omitempty"`
+	Depends       []string  `json:"depends,omitempty"`
+	RequiredBy    []string  `json:"required_by,omitempty"`
+	RolledBack    *pin      `json:"rolled_back,omitempty"`
+	History       []state   `json:"history,omitempty"`
+	Size          int64     `json:"size"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func newInfoCmd(common commonCmd, git git.Backend) infoCmd {
+	cmd := &infoCmd{}
+	cmd.commonCmd = common
+	cmd.git = git
+	setupCmdFlags(cmd, "info", cmd.usage)
+	setupOutputFlag(cmd)
+	return *cmd
+}
+
+func (cmd *infoCmd) usage() {
+	const help = `Summary:
+  Show details of an installed package.
+
+Syntax:
+  {{.Prog}} {{.Cmd}} <package> [--output json]
+
+Source of the package is one of the followings:
+  install  # Installed by "install" command
+  bundle   # Installed by "bundle" command according to config file
+  link     # Pseudo package created by "link" command
+  unknown  # Installed by older version of {{.Prog}}
+
+Options:
+`
+
+	t := template.Must(template.New("usage").Parse(help))
+	t.Execute(cmd.errs, struct{ Prog, Cmd string }{cmd.name, "info"})
+
+	cmd.flags.PrintDefaults()
+}
+
+func (cmd *infoCmd) parseAndExec(args []string) error {
+	done, err := parseStart(cmd, args, true, true)
+	if done || err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cmd, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := packageDetails(cmd, cmd.flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if isJSONOutput(cmd) {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+			return ErrOperationFailed
+		}
+		fmt.Fprintln(cmd.outs, string(data))
+		return nil
+	}
+
+	source := info.Source
+	switch {
+	case info.Source == modeBundle:
+		source += " (config file)"
+	case info.Configured:
+		source += " (configured)"
+	}
+	branch := info.Branch
+	if branch != "" && info.TracksDefault {
+		branch += " (default)"
+	}
+	bins := strings.Join(info.Bins, ", ")
+	rolledBack := ""
+	if info.RolledBack != nil {
+		rolledBack = fmt.Sprintf("from %s", shortCommit(info.RolledBack.From))
+	}
+	history := []string{}
+	for _, st := range info.History {
+		history = append(history, shortCommit(st.Commit))
+	}
+	updatedAt := ""
+	if !info.UpdatedAt.IsZero() {
+		updatedAt = info.UpdatedAt.Format(time.RFC3339)
+	}
+
+	rows := [][]string{
+		{"Name", info.Name},
+		{"Path", info.Path},
+		{"Source", source},
+		{"URL", info.URL},
+		{"Branch", branch},
+		{"Tag", info.Tag},
+		{"Constraint", info.Constraint},
+		{"Commit", info.Commit},
+		{"Executables", bins},
+		{"Completions", strings.Join(info.Completions, ", ")},
+		{"Man pages", strings.Join(info.Man, ", ")},
+		{"Auto-source", strings.Join(info.SourceFiles, ", ")},
+		{"Depends", strings.Join(info.Depends, ", ")},
+		{"Required by", strings.Join(info.RequiredBy, ", ")},
+		{"Rolled back", rolledBack},
+		{"History", strings.Join(history, ", ")},
+		{"Disk size", formatSize(info.Size)},
+		{"Updated at", updatedAt},
+	}
+	for _, row := range rows {
+		if row[1] == "" {
+			row[1] = "-"
+		}
+		fmt.Fprintf(cmd.outs, "%-12s %s\n", row[0]+":", row[1])
+	}
+
+	return nil
+}
+
+// packageDetails collects details of an installed package by its receipt and working tree
+func packageDetails(cmd gitRunner, name string) (packageInfo, error) {
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	info := packageInfo{Name: name, Path: path, Source: "unknown", Bins: []string{}}
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(cmd.getErrs(), "\"%s\" is not installed\n", name)
+		return info, ErrArgument
+	}
+
+	rc, hasReceipt := loadReceipt(cmd.getConfig(), name)
+	if hasReceipt {
+		info.Source = rc.Mode
+		info.Bins = rc.Bins
+		info.UpdatedAt = rc.UpdatedAt
+		info.Constraint = rc.Constraint
+		info.Completions = rc.Completions
+		info.Man = rc.Man
+		info.SourceFiles = rc.Source
+		info.Depends = rc.Depends
+		info.RolledBack = rc.Pin
+		info.History = rc.History
+	} else {
+		info.Bins = linksIntoPackage(cmd, path)
+		info.UpdatedAt = stat.ModTime()
+	}
+
+	repo, err := cmd.getGit().Worktree(path, *cmd.getVerboseOpts().getVerbose())
+	if err == nil {
+		info.URL = repo.RemoteURL
+		info.Branch = repo.Branch
+		info.Tag = repo.Tag
+		info.Commit = repo.Commit
+		info.TracksDefault = repo.Branch != "" && repo.IsBranchDefault()
+	}
+	if info.URL == "" && hasReceipt {
+		info.URL = rc.URL
+	}
+
+	for _, param := range cmd.getConfig().Packages {
+		pkg, err := packageToInstall(cmd, installArgs{from: param.From, as: param.As, at: param.At})
+		if err == nil && pkg.name == name {
+			info.Configured = true
+			break
+		}
+	}
+
+	if dependents := dependentsOf(cmd, name); len(dependents) > 0 {
+		info.RequiredBy = dependents
+	}
+
+	if info.Size, err = diskSize(path); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Warning! Can't calculate disk size. Error = %v\n", err)
+	}
+
+	return info, nil
+}
+
+// linksIntoPackage returns names of links in BinPath which point into the package
+func linksIntoPackage(cmd runner, pkgPath string) []string {
+	names := []string{}
+	bins, err := ioutil.ReadDir(cmd.getConfig().BinPath())
+	if err != nil {
+		return names
+	}
+	for _, bin := range bins {
+		src, err := os.Readlink(filepath.Join(cmd.getConfig().BinPath(), bin.Name()))
+		if err == nil && isInPackage(src, pkgPath) {
+			names = append(names, bin.Name())
+		}
+	}
+	return names
+}
+
+// diskSize returns total size of files in the directory. Symbolic link of the directory itself is
+// resolved
+func diskSize(path string) (int64, error) {
+	root, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = filepath.Walk(root, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
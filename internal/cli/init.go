@@ -1,19 +1,33 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"github.com/progrhyme/shelp/internal/config"
 )
 
+// initShells are names of shells which init scripts can be compiled for
+var initShells = []string{
+	"sh", "bash", "zsh", "ksh", "mksh", "dash", "ash", "yash",
+	"fish", "tcsh", "csh", "pwsh", "powershell", "nu", "elvish", "xonsh",
+}
+
+// compiledConfigHeader precedes path of config file in header of compiled init scripts
+const compiledConfigHeader = "# Config: "
+
 type initCmd struct {
 	helpCmd
-	shell  string
-	shProf string
+	shell   string
+	shProf  string
+	compile *bool
 }
 
 func newInitCmd(common commonCmd) initCmd {
@@ -24,6 +38,7 @@ func newInitCmd(common commonCmd) initCmd {
 	cmd.shProf = shellProfile(cmd.shell)
 
 	setupCmdFlags(cmd, "init", cmd.usage)
+	cmd.compile = cmd.flags.Bool("compile", false, "# Write scripts into file to be sourced")
 	return *cmd
 }
 
@@ -44,6 +59,18 @@ func shellProfile(shell string) string {
 		prof = "~/.zshrc"
 	case "fish":
 		prof = "~/.config/fish/config.fish"
+	case "tcsh":
+		prof = "~/.tcshrc"
+	case "csh":
+		prof = "~/.cshrc"
+	case "pwsh", "powershell":
+		prof = "$PROFILE"
+	case "nu":
+		prof = "~/.config/nushell/config.nu"
+	case "elvish":
+		prof = "~/.config/elvish/rc.elv"
+	case "xonsh":
+		prof = "~/.xonshrc"
 	default:
 		prof = "its profile"
 	}
@@ -55,30 +82,75 @@ func (cmd *initCmd) usage() {
   Enable {{.Prog}} in one's shell environment.
 
 Usage:
-    {{.Prog}} init - [SHELL]  # Print scripts (for specified SHELL)
+    {{.Prog}} init - [SHELL]          # Print scripts (for specified SHELL)
+    {{.Prog}} init --compile [SHELL]  # Write scripts into file (for specified SHELL)
 
   To enable {{.Prog}} automatically in one's shell, append the following to {{.Profile}}:
 
     {{.InitCommand}}
-
+{{if .Note}}
+  {{.Note}}
+{{end}}
   It prints scripts for current shell unless user specify SHELL argument.
 
+  For faster shell startup, write scripts into file by "--compile" option once, and append the
+  following instead. The file is rewritten whenever packages are changed by install, remove,
+  bundle, upgrade and so on. Run "--compile" again after editing "source" in config file:
+
+    {{.SourceCommand}}
+
+  The scripts also set up completions and man pages of packages, and source files of packages
+  listed in "source" of config file or manifest of packages. For Zsh, put it before "compinit"
+  so that completion functions of packages are found.
+
 Supported Shells:
 - Most POSIX compatible shells including Zsh
 - fish shell
+- tcsh and csh
+- PowerShell (pwsh)
+- Nushell (nu)
+- Elvish
+- Xonsh
+
+  Scripts in packages are loaded by "include <package> <file>" in all shells but PowerShell and
+  Nushell. PowerShell needs dot-sourcing like ". include <package> <file>" to load them into
+  the caller's scope. Nushell can't load files decided at runtime, so the scripts source files
+  listed in "source" by their paths. Elvish evaluates the scripts in a namespace of their own, so
+  functions and variables defined in them need to be exported by "edit:add-var" to be used later.
 
 Options:
 `
 
 	t := template.Must(template.New("usage").Parse(help))
-	params := struct{ Prog, Profile, InitCommand string }{
+	params := struct{ Prog, Profile, InitCommand, Note, SourceCommand string }{
 		Prog: cmd.name, Profile: cmd.shProf,
 	}
+	file := shellQuote(cmd.shell, cmd.config.InitScriptFile(cmd.shell))
 	switch cmd.shell {
 	case "fish":
 		params.InitCommand = fmt.Sprintf(`%s init - | source`, cmd.name)
+		params.SourceCommand = fmt.Sprintf(`source %s`, file)
+	case "tcsh", "csh":
+		params.InitCommand = fmt.Sprintf("eval \"`%s init -`\"", cmd.name)
+		params.SourceCommand = fmt.Sprintf(`source %s`, file)
+	case "pwsh", "powershell":
+		params.InitCommand = fmt.Sprintf(`%s init - | Out-String | Invoke-Expression`, cmd.name)
+		params.SourceCommand = fmt.Sprintf(`Invoke-Expression (Get-Content -Raw %s)`, file)
+	case "nu":
+		params.InitCommand = fmt.Sprintf(`source %s`, file)
+		params.Note = fmt.Sprintf(
+			`Nushell can't evaluate output of command. Run "%s init --compile nu" beforehand.`,
+			cmd.name)
+		params.SourceCommand = params.InitCommand
+	case "elvish":
+		params.InitCommand = fmt.Sprintf(`eval (%s init - | slurp)`, cmd.name)
+		params.SourceCommand = fmt.Sprintf(`eval (slurp < %s)`, file)
+	case "xonsh":
+		params.InitCommand = fmt.Sprintf(`execx($(%s init -))`, cmd.name)
+		params.SourceCommand = fmt.Sprintf(`source %s`, file)
 	default:
-		params.InitCommand = fmt.Sprintf(`eval "$(%s init -)`, cmd.name)
+		params.InitCommand = fmt.Sprintf(`eval "$(%s init -)"`, cmd.name)
+		params.SourceCommand = fmt.Sprintf(`. %s`, file)
 	}
 	t.Execute(cmd.errs, params)
 
@@ -102,11 +174,17 @@ func (cmd *initCmd) parseAndExec(args []string) error {
 		}
 	}
 
-	if print {
-		cmd.printInitShellScripts(cmd.outs)
-	} else {
+	switch {
+	case *cmd.compile:
+		if err = compileInitScripts(cmd, cmd.shell); err != nil {
+			return err
+		}
+		file := cmd.config.InitScriptFile(cmd.shell)
+		fmt.Fprintf(cmd.outs, "Wrote init scripts for %s: %s\n", cmd.shell, file)
+	case print:
+		printInitScripts(cmd.outs, cmd, cmd.shell)
+	default:
 		cmd.flags.Usage()
-		return nil
 	}
 
 	return nil
@@ -117,9 +195,10 @@ func (cmd *initCmd) resetShell() {
 	cmd.flags.Usage = cmd.usage
 }
 
-func (cmd *initCmd) printInitShellScripts(out io.Writer) {
+// printInitScripts prints scripts to enable shelp in the shell
+func printInitScripts(out io.Writer, cmd runner, shell string) {
 	var script string
-	switch cmd.shell {
+	switch shell {
 	case "fish":
 		script = `set -gx <<.RootPathKey>> <<.RootPath>>
 if not contains <<.BinPath>> $PATH
@@ -148,6 +227,137 @@ function include
     return 1
   end
 end
+
+# Completions, functions and man pages of packages
+if not contains <<.SharePath>>/fish/vendor_completions.d $fish_complete_path
+  set -g fish_complete_path <<.SharePath>>/fish/vendor_completions.d $fish_complete_path
+end
+if not contains <<.SharePath>>/fish/vendor_functions.d $fish_function_path
+  set -g fish_function_path <<.SharePath>>/fish/vendor_functions.d $fish_function_path
+end
+for file in <<.SharePath>>/fish/vendor_conf.d/*.fish
+  source $file
+end
+if not contains <<.SharePath>>/man $MANPATH
+  set -gx MANPATH <<.SharePath>>/man $MANPATH
+  # Empty entry lets man look up default paths
+  contains "" $MANPATH; or set -gx MANPATH $MANPATH ""
+end
+`
+
+	case "tcsh", "csh":
+		// Output of command is evaluated as a single line by csh. So each statement ends with
+		// ";" and no comment is put
+		script = `setenv <<.RootPathKey>> "<<.RootPath>>";
+setenv PATH "<<.BinPath>>:${PATH}";
+alias include 'source "${<<.RootPathKey>>}/packages/\!:1/\!:2"';
+if ( ! $?MANPATH ) setenv MANPATH "";
+setenv MANPATH "<<.SharePath>>/man:${MANPATH}";
+`
+
+	case "pwsh", "powershell":
+		script = `$env:<<.RootPathKey>> = '<<.RootPath>>'
+if (($env:PATH -split [IO.Path]::PathSeparator) -notcontains '<<.BinPath>>') {
+  $env:PATH = '<<.BinPath>>' + [IO.Path]::PathSeparator + $env:PATH
+}
+
+# Load script in a package. Dot-source it like ". include <package> <file>" to load the script
+# into the caller's scope
+function include {
+  param([string]$Package, [string]$File)
+
+  if (-not $Package -or -not $File) {
+    Write-Error 'Usage: . include <package> <file>'
+    return
+  }
+
+  if (-not (Test-Path "$env:<<.RootPathKey>>/packages/$Package")) {
+    Write-Error "Package not installed: $Package"
+    return
+  }
+
+  if (Test-Path "$env:<<.RootPathKey>>/packages/$Package/$File") {
+    . "$env:<<.RootPathKey>>/packages/$Package/$File"
+  } else {
+    Write-Error "File not found: $env:<<.RootPathKey>>/packages/$Package/$File"
+  }
+}
+
+# Man pages of packages
+if (($env:MANPATH -split ':') -notcontains '<<.SharePath>>/man') {
+  $env:MANPATH = '<<.SharePath>>/man:' + $env:MANPATH
+}
+`
+
+	case "nu":
+		script = `$env.<<.RootPathKey>> = '<<.RootPath>>'
+$env.PATH = ($env.PATH | split row (char esep) | where {|p| $p != '<<.BinPath>>' }
+  | prepend '<<.BinPath>>')
+
+# Man pages of packages
+$env.MANPATH = ($env.MANPATH? | default '' | split row (char esep)
+  | where {|p| $p != '<<.SharePath>>/man' } | prepend '<<.SharePath>>/man' | str join (char esep))
+`
+
+	case "elvish":
+		script = `use path
+use str
+set-env <<.RootPathKey>> '<<.RootPath>>'
+set paths = ['<<.BinPath>>' (each {|p| if (not-eq $p '<<.BinPath>>') { put $p } } $paths)]
+
+# Load script in a package
+fn include {|package file|
+  if (not (path:is-dir $E:<<.RootPathKey>>/packages/$package)) {
+    echo 'Package not installed: '$package >&2
+    return
+  }
+
+  var file-path = $E:<<.RootPathKey>>/packages/$package/$file
+  if (path:is-regular $file-path) {
+    eval (slurp < $file-path)
+  } else {
+    echo 'File not found: '$file-path >&2
+  }
+}
+# Definitions by "eval" are lost after it. So export the function to the interactive namespace
+edit:add-var include~ $include~
+
+# Man pages of packages
+if (not (has-value [(str:split : $E:MANPATH)] '<<.SharePath>>/man')) {
+  set E:MANPATH = '<<.SharePath>>/man:'$E:MANPATH
+}
+`
+
+	case "xonsh":
+		script = `import os as _shelp_os
+import sys as _shelp_sys
+
+$<<.RootPathKey>> = '<<.RootPath>>'
+if '<<.BinPath>>' not in $PATH:
+    $PATH.insert(0, '<<.BinPath>>')
+
+# Load script in a package
+def _shelp_include(args):
+    if len(args) != 2:
+        print('Usage: include <package> <file>', file=_shelp_sys.stderr)
+        return 1
+
+    package, file = args
+    if not _shelp_os.path.exists($<<.RootPathKey>> + '/packages/' + package):
+        print('Package not installed: ' + package, file=_shelp_sys.stderr)
+        return 1
+
+    path = $<<.RootPathKey>> + '/packages/' + package + '/' + file
+    if _shelp_os.path.exists(path):
+        source @(path)
+    else:
+        print('File not found: ' + path, file=_shelp_sys.stderr)
+        return 1
+
+aliases['include'] = _shelp_include
+
+# Man pages of packages
+$MANPATH = '<<.SharePath>>/man' + _shelp_os.pathsep + ${...}.detype().get('MANPATH', '')
 `
 
 	default:
@@ -180,11 +390,122 @@ include() {
     return 1
   fi
 }
+
+# Completions and man pages of packages
+case ":${MANPATH:-}:" in
+  *":<<.SharePath>>/man:"*) ;;
+  *) export MANPATH="<<.SharePath>>/man:${MANPATH:-}" ;;
+esac
+case ":${XDG_DATA_DIRS:-}:" in
+  *":<<.SharePath>>:"*) ;;
+  *) export XDG_DATA_DIRS="<<.SharePath>>:${XDG_DATA_DIRS:-/usr/local/share:/usr/share}" ;;
+esac
+<<- if eq .Shell "zsh">>
+fpath=("<<.SharePath>>/zsh/site-functions" $fpath)
+<<- end>>
 `
 	}
 
-	params := struct{ RootPathKey, RootPath, BinPath string }{
-		config.RootVarName, cmd.config.RootPath(), cmd.config.BinPath()}
+	cfg := cmd.getConfig()
+	params := struct{ Shell, RootPathKey, RootPath, BinPath, SharePath string }{
+		shell, config.RootVarName, cfg.RootPath(), cfg.ShellBinPath(), cfg.ShellSharePath()}
 	t := template.Must(template.New("script").Delims("<<", ">>").Parse(script))
 	t.Execute(out, params)
+	printSourceScripts(out, cfg, shell, packageSources(cmd, shell))
+}
+
+// compileInitScripts writes init scripts for the shell into file. The file is replaced by rename so
+// that shells starting up never read it partially
+func compileInitScripts(cmd runner, shell string) error {
+	if shell == "" || shell == "." || filepath.Base(shell) != shell {
+		fmt.Fprintf(cmd.getErrs(), "Error! Invalid shell: \"%s\"\n", shell)
+		return ErrArgument
+	}
+	if !containsString(initShells, shell) {
+		fmt.Fprintf(cmd.getErrs(), "Error! Unsupported shell: \"%s\"\n", shell)
+		return ErrArgument
+	}
+	file := cmd.getConfig().InitScriptFile(shell)
+	var buf bytes.Buffer
+	fmt.Fprintf(
+		&buf, "# Generated by \"%s init --compile %s\". Don't edit\n", cmd.getName(), shell)
+	if cmd.getConfig().IsLoaded() {
+		fmt.Fprintf(&buf, "%s%s\n", compiledConfigHeader, cmd.getConfig().File())
+	}
+	printInitScripts(&buf, cmd, shell)
+
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".*")
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't write %s. Error = %v\n", file, err)
+		return ErrOperationFailed
+	}
+	return nil
+}
+
+// recompileInitScripts rewrites init scripts compiled by "init --compile" to reflect changes of
+// packages. It is called by commands which change packages before they release the lock. Scripts
+// are compiled with the config file used by "init --compile" in place of the caller's one
+func recompileInitScripts(cmd runner) {
+	files, err := filepath.Glob(cmd.getConfig().InitScriptFile("*"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		shell := strings.TrimPrefix(filepath.Ext(file), ".")
+		if !containsString(initShells, shell) {
+			continue
+		}
+		compiler := cmd
+		if path := compiledConfig(file); path != cmd.getConfig().File() {
+			cfg := config.NewConfig(cmd.getOuts(), cmd.getErrs())
+			if err = cfg.LoadConfig(path); err != nil {
+				fmt.Fprintf(cmd.getErrs(), "Warning! Can't update %s\n", file)
+				continue
+			}
+			cfg.Path.Root = cmd.getConfig().RootPath()
+			compiler = &commonCmd{
+				config: &cfg, outs: cmd.getOuts(), errs: cmd.getErrs(), name: cmd.getName(),
+				ctx: cmd.getContext(),
+			}
+		}
+		if err = compileInitScripts(compiler, shell); err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Warning! Can't update %s\n", file)
+		}
+	}
+}
+
+// compiledConfig returns path of config file recorded in the header of compiled init scripts
+func compiledConfig(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+		if line := scanner.Text(); strings.HasPrefix(line, compiledConfigHeader) {
+			return strings.TrimPrefix(line, compiledConfigHeader)
+		}
+	}
+	return ""
 }
@@ -8,11 +8,16 @@ import (
 	"regexp"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/progrhyme/shelp/internal/config"
 	"github.com/progrhyme/shelp/internal/git"
+	"github.com/progrhyme/shelp/internal/semver"
 )
 
+// remoteLocation matches location of a package in the form of "[<site>/]<account>/<repo>[@<ref>]"
+var remoteLocation = regexp.MustCompile(`^(?:([\w\-\.]+)/)?([\w\-\.]+)/([\w\-\.]+)(?:@(.+))?$`)
+
 type installCmd struct {
 	gitCmd
 	command string
@@ -22,11 +27,20 @@ type installArgs struct {
 	from      string
 	as        string
 	at        string
+	commit    string
 	bin       []string
+	depends   []string
 	overwrite bool
+	// How to deal with local changes of installed package on re-install
+	strategy string
+	mode     string
+	// Names of packages which are being installed and depend on this one
+	chain []string
+	// Shared by packages installed together. Created by installPackage if not given
+	session *installSession
 }
 
-func newInstallCmd(common commonCmd, git git.Git) installCmd {
+func newInstallCmd(common commonCmd, git git.Backend) installCmd {
 	cmd := &installCmd{}
 	cmd.commonCmd = common
 	cmd.git = git
@@ -47,11 +61,16 @@ Syntax:
 
 If you ommit preceding "<site>/" specifier in former syntax, "github.com" is used by default.
 You can specify any branch or tag or commit hash for "@<ref>" parameter.
+Version constraint like "^2.2", "~1.4.0", ">=3 <4" or "latest" is also available for "@<ref>". It is
+resolved to the newest tag satisfying it, and "upgrade" moves the package to newer one within it.
+
+If the repository has "shelp.yml" manifest file at its root, executables declared in it are linked.
 
 Examples:
   # Handy syntax
   {{.Prog}} {{.Cmd}} b4b4r07/enhancd           # Install "enhancd" from github.com
   {{.Prog}} {{.Cmd}} b4b4r07/enhancd@v2.2.4    # Install specified tag or branch
+  {{.Prog}} {{.Cmd}} b4b4r07/enhancd@^2.2      # Install the newest tag of 2.x (>= 2.2)
   {{.Prog}} {{.Cmd}} bats-core/bats-core bats  # Install as "bats"
   {{.Prog}} {{.Cmd}} gitlab.com/dwt1/dotfiles  # Install from gitlab.com
 
@@ -84,12 +103,20 @@ func (cmd *installCmd) parseAndExec(args []string) error {
 		return err
 	}
 
-	if err = prepareInstallDirectories(cmd.config); err != nil {
-		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
-		return ErrOperationFailed
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !isDryRun(cmd) {
+		if err = prepareInstallDirectories(cmd.config); err != nil {
+			fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+			return ErrOperationFailed
+		}
 	}
 
-	param := installArgs{from: cmd.flags.Arg(0)}
+	param := installArgs{from: cmd.flags.Arg(0), mode: modeInstall}
 	if cmd.flags.NArg() > 1 {
 		param.as = cmd.flags.Arg(1)
 	}
@@ -122,9 +149,8 @@ func packageToInstall(cmd verboseRunner, args installArgs) (shelpkg, error) {
 		pkg.name = args.as
 	}
 
-	re = regexp.MustCompile(`^(?:([\w\-\.]+)/)?([\w\-\.]+)/([\w\-\.]+)(?:@([\w\-\.]+))?$`)
-	if re.MatchString(args.from) {
-		matched := re.FindStringSubmatch(args.from)
+	if remoteLocation.MatchString(args.from) {
+		matched := remoteLocation.FindStringSubmatch(args.from)
 		site := matched[1]
 		if site == "" {
 			site = "github.com"
@@ -146,7 +172,16 @@ func packageToInstall(cmd verboseRunner, args installArgs) (shelpkg, error) {
 	if args.at != "" {
 		pkg.ref = args.at
 	}
-	if pkg.ref != "" {
+	pkg.commit = args.commit
+	if semver.IsConstraint(pkg.ref) {
+		if _, err := semver.ParseConstraint(pkg.ref); err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+			return pkg, ErrArgument
+		}
+		// Resolved into a tag on installation
+		pkg.constraint = pkg.ref
+		pkg.ref = ""
+	} else if pkg.ref != "" {
 		re = regexp.MustCompile(`^[0-9a-f]{7,}$`)
 		if re.MatchString(pkg.ref) {
 			pkg.isCommitHash = true
@@ -156,21 +191,26 @@ func packageToInstall(cmd verboseRunner, args installArgs) (shelpkg, error) {
 	return pkg, nil
 }
 
+// packageInstalled returns state of installed package by its receipt, or working tree if it has no
+// receipt
 func packageInstalled(cmd gitRunner, path string) (shelpkg, error) {
-	pkg := shelpkg{}
-	pwd, err := chdir(cmd, path)
-	if err != nil {
-		return pkg, ErrOperationFailed
+	pkg := shelpkg{name: filepath.Base(path)}
+	if rc, ok := loadReceipt(cmd.getConfig(), pkg.name); ok && rc.Mode != modeLink {
+		pkg.url = rc.URL
+		pkg.ref = rc.Ref
+		pkg.commit = rc.Commit
+		pkg.isBranchDefault = rc.TracksDefault
+		return pkg, nil
 	}
-	defer os.Chdir(pwd)
 
-	repo, err := cmd.getGit().Worktree(*cmd.getVerboseOpts().getVerbose())
+	repo, err := cmd.getGit().Worktree(path, *cmd.getVerboseOpts().getVerbose())
 	if err != nil {
 		return pkg, ErrOperationFailed
 	}
 
 	pkg.url = repo.RemoteURL
 	pkg.ref = repo.BranchOrTag()
+	pkg.commit = repo.Commit
 	if pkg.ref == repo.Branch && repo.IsBranchDefault() {
 		pkg.isBranchDefault = true
 	}
@@ -183,6 +223,14 @@ func installPackage(cmd gitRunner, args installArgs) error {
 	if err != nil {
 		return err
 	}
+	if args.session == nil {
+		args.session = newInstallSession()
+	}
+	release, err := args.session.claim(cmd, pkg.name, args.chain)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	pkgPath := filepath.Join(cmd.getConfig().PackagePath(), pkg.name)
 	reinstall := false
@@ -198,7 +246,7 @@ func installPackage(cmd gitRunner, args installArgs) error {
 
 		// Always overwrite pseudo package created by "link" command
 		now := shelpkg{}
-		if !isSymlink(pkgPath, cmd.getErrs()) {
+		if !isLinkedPackage(cmd, pkg.name) {
 			now, err = packageInstalled(cmd, pkgPath)
 			if err != nil {
 				return err
@@ -206,33 +254,55 @@ func installPackage(cmd gitRunner, args installArgs) error {
 			if pkg.isEquivalent(now) {
 				return alreadyInstalled()
 			}
+			if err = checkLocalChanges(cmd, pkg.name, args.strategy); err != nil {
+				return err
+			}
 		}
 
 		// Re-install
 		reinstall = true
 		fmt.Fprintf(cmd.getErrs(), "Re-install \"%s\"\n", pkg.name)
-		if pkg.url != now.url {
-			fmt.Fprintf(cmd.getErrs(), "  from: %s => %s\n", now.url, pkg.url)
+		for _, change := range pkg.changesFrom(now) {
+			fmt.Fprintf(cmd.getErrs(), "  %s\n", change)
 		}
-		if pkg.ref != now.ref && (pkg.ref != "" || !now.isBranchDefault) {
-			newref := pkg.ref
-			if newref == "" {
-				newref = "(default)"
-			}
-			fmt.Fprintf(cmd.getErrs(), "  at: %s => %s\n", now.ref, newref)
+	}
+
+	if pkg.constraint != "" && pkg.commit == "" {
+		tag, err := resolveConstraint(cmd, pkg.url, pkg.constraint)
+		if err != nil {
+			return err
 		}
+		if tag == "" {
+			fmt.Fprintf(
+				cmd.getErrs(), "Error! No tag satisfies \"%s\". Package = %s, From = %s\n",
+				pkg.constraint, pkg.name, pkg.url)
+			return ErrArgument
+		}
+		fmt.Fprintf(cmd.getOuts(), "Resolved \"%s\" to tag %s\n", pkg.constraint, tag)
+		pkg.ref = tag
 	}
 
 	gitOpts := git.Option{
 		Shallow: cmd.getConfig().Git.Shallow,
 		Verbose: *cmd.getVerboseOpts().getVerbose(),
 	}
-	if pkg.isCommitHash {
+	if pkg.commit != "" {
+		gitOpts.Commit = pkg.commit
+	} else if pkg.isCommitHash {
 		gitOpts.Commit = pkg.ref
 	} else {
 		gitOpts.Branch = pkg.ref
 	}
 	tmpath := filepath.Join(cmd.getConfig().TempPath(), pkg.name)
+	if isDryRun(cmd) {
+		if err = installDependencies(cmd, args, pkg.name, args.depends); err != nil {
+			return err
+		}
+		return reportInstall(cmd, pkg, args, gitOpts, reinstall)
+	}
+	if interrupted(cmd) {
+		return ErrInterrupted
+	}
 	err = cmd.getGit().Clone(pkg.url, tmpath, gitOpts)
 
 	defer func() {
@@ -243,13 +313,27 @@ func installPackage(cmd gitRunner, args installArgs) error {
 		}
 	}()
 
+	if err != nil && interrupted(cmd) {
+		return ErrInterrupted
+	}
 	if err != nil {
 		fmt.Fprintf(
 			cmd.getErrs(), "Error! Installation failed. Package = %s, From = %s\n", pkg.name, pkg.url)
 		return ErrCommandFailed
 	}
 
+	// Dependencies are installed before the package is put in place
+	manifest := loadPackageManifest(cmd, pkg.name, tmpath)
+	depends := append(append([]string{}, args.depends...), manifest.Depends...)
+	if err = installDependencies(cmd, args, pkg.name, depends); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Installation failed. Package = %s\n", pkg.name)
+		return err
+	}
+
+	// Previous state is kept in history of the package to roll back
+	prev := receipt{}
 	if reinstall {
+		prev, _ = loadReceipt(cmd.getConfig(), pkg.name)
 		fmt.Fprintf(cmd.getOuts(), "Removing existing \"%s\" ... ", pkg.name)
 		if err = removePackage(cmd, pkg.name, true); err != nil {
 			return err
@@ -262,19 +346,44 @@ func installPackage(cmd gitRunner, args installArgs) error {
 		return ErrOperationFailed
 	}
 
-	var linkErr error
-	if len(args.bin) > 0 {
-		for _, bin := range args.bin {
-			linkErr = createLinkByBinAndDir(cmd, bin, pkgPath)
-		}
-	} else {
-		binPath := filepath.Join(pkgPath, "bin")
-		if _, err := os.Stat(binPath); err == nil {
-			linkErr = createLinksByBinDir(cmd, binPath)
-		} else {
-			linkErr = createLinksByBinDir(cmd, pkgPath)
-		}
+	// Bins in config take precedence over ones in manifest of the package
+	bins := args.bin
+	if len(bins) == 0 {
+		bins = manifest.Bin
+	}
+	bins, linkErr := linkPackageBins(cmd, pkgPath, bins)
+	completions, man, shareErr := linkPackageShare(cmd, pkgPath, manifest)
+	if linkErr == nil {
+		linkErr = shareErr
+	}
+
+	rc := receipt{
+		Name:        pkg.name,
+		Mode:        args.mode,
+		From:        args.from,
+		At:          args.at,
+		Constraint:  pkg.constraint,
+		Shallow:     gitOpts.Shallow && gitOpts.Commit == "",
+		Bins:        bins,
+		Completions: completions,
+		Man:         man,
+		Source:      manifest.Source,
+		Shells:      manifest.Shells,
+		Depends:     dependencyNames(cmd, depends),
+	}
+	if repo, err := cmd.getGit().Worktree(pkgPath, gitOpts.Verbose); err == nil {
+		rc.URL = repo.RemoteURL
+		rc.Ref = repo.BranchOrTag()
+		rc.Commit = repo.Commit
+		rc.TracksDefault = rc.Ref == repo.Branch && repo.IsBranchDefault()
 	}
+	rc.recordPrevious(prev)
+	rc.InstalledAt = time.Now()
+	rc.UpdatedAt = rc.InstalledAt
+	if err = rc.save(cmd); err != nil {
+		return err
+	}
+
 	if linkErr != nil {
 		fmt.Fprintf(cmd.getErrs(), "\"%s\" is installed, but with some failures\n", pkg.name)
 		return linkErr
@@ -284,52 +393,169 @@ func installPackage(cmd gitRunner, args installArgs) error {
 	return nil
 }
 
-func createLinksByBinDir(cmd verboseRunner, path string) error {
+// checkLocalChanges tells whether a package with local changes can be re-installed by given
+// strategy. Re-install replaces the working tree, so stashed changes are left in the previous
+// generation instead of a stash of git
+func checkLocalChanges(cmd gitRunner, name, strategy string) error {
+	if strategy == forceLocal {
+		return nil
+	}
+	st, err := localStatus(cmd, name)
+	if err != nil || st.IsClean() {
+		return err
+	}
+	switch {
+	case strategy == stashLocal && st.Unpushed == 0:
+		fmt.Fprintf(
+			cmd.getErrs(), "Local changes of \"%s\" are left in the previous generation. "+
+				"Use \"rollback --generation\" to restore them\n", name)
+		return nil
+	case strategy == stashLocal:
+		fmt.Fprintf(
+			cmd.getErrs(), "Skip re-installing \"%s\". Unpushed commits can't be stashed. "+
+				"Use \"--force\" to drop them\n", name)
+		return ErrLocalChanges
+	default:
+		fmt.Fprintf(
+			cmd.getErrs(), "Skip re-installing \"%s\". Use \"--force\" to discard them\n", name)
+		return ErrLocalChanges
+	}
+}
+
+// reportInstall reports what installPackage would do in dry-run mode
+func reportInstall(
+	cmd gitRunner, pkg shelpkg, args installArgs, opts git.Option, reinstall bool) error {
+	pkgPath := filepath.Join(cmd.getConfig().PackagePath(), pkg.name)
+	tmpath := filepath.Join(cmd.getConfig().TempPath(), pkg.name)
+
+	ref := opts.Commit
+	if ref == "" {
+		ref = opts.Branch
+	}
+	if ref != "" {
+		wouldDo(cmd, "clone %s at %s into %s", pkg.url, ref, tmpath)
+	} else {
+		wouldDo(cmd, "clone %s into %s", pkg.url, tmpath)
+	}
+
+	if reinstall {
+		if err := removePackage(cmd, pkg.name, true); err != nil {
+			return err
+		}
+	}
+	wouldDo(cmd, "move %s => %s", tmpath, pkgPath)
+
+	if len(args.bin) == 0 {
+		wouldDo(cmd, "symlink executables of %s into %s", pkgPath, cmd.getConfig().BinPath())
+	}
+	for _, bin := range args.bin {
+		sym := filepath.Join(cmd.getConfig().BinPath(), filepath.Base(bin))
+		wouldDo(cmd, "symlink %s -> %s", sym, filepath.Join(pkgPath, bin))
+	}
+	wouldDo(
+		cmd, "symlink completions and man pages of %s into %s", pkgPath, cmd.getConfig().SharePath())
+	return nil
+}
+
+// linkPackageBins creates symlinks for executables in a package and returns names of them.
+// If bins are not specified by config nor manifest of the package, executables in "bin"
+// directory, or in the package root directory if it does not exist, are linked
+func linkPackageBins(cmd verboseRunner, pkgPath string, bins []string) ([]string, error) {
+	if len(bins) == 0 {
+		binPath := filepath.Join(pkgPath, "bin")
+		if _, err := os.Stat(binPath); err == nil {
+			return createLinksByBinDir(cmd, binPath)
+		}
+		return createLinksByBinDir(cmd, pkgPath)
+	}
+
+	linked := []string{}
+	var warn bool
+	for _, bin := range bins {
+		if _, ok := packageFile(pkgPath, bin); !ok {
+			fmt.Fprintf(cmd.getErrs(), "Warning! File is out of package: %s\n", bin)
+			warn = true
+			continue
+		}
+		name, err := createLinkByBinAndDir(cmd, bin, pkgPath)
+		switch err {
+		case nil:
+			linked = append(linked, name)
+		case ErrWarning:
+			warn = true
+		default:
+			return linked, err
+		}
+	}
+	if warn {
+		return linked, ErrWarning
+	}
+	return linked, nil
+}
+
+func createLinksByBinDir(cmd verboseRunner, path string) ([]string, error) {
+	linked := []string{}
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
-		return ErrOperationFailed
+		return linked, ErrOperationFailed
 	}
 
 	var warn bool
 	for _, file := range files {
 		if !file.IsDir() && isExecutable(file.Mode()) {
-			err = createLinkByBinAndDir(cmd, file.Name(), path)
+			name, err := createLinkByBinAndDir(cmd, file.Name(), path)
 			switch err {
 			case ErrWarning:
 				warn = true
 				continue
 			case nil:
-				// Nothing to do
+				linked = append(linked, name)
 			default:
-				return err
+				return linked, err
 			}
 		}
 	}
 	if warn {
-		return ErrWarning
+		return linked, ErrWarning
 	}
 
-	return nil
+	return linked, nil
 }
 
-func createLinkByBinAndDir(cmd verboseRunner, bin, path string) error {
+func createLinkByBinAndDir(cmd verboseRunner, bin, path string) (string, error) {
 	exe := filepath.Join(path, bin)
-	sym := filepath.Join(cmd.getConfig().BinPath(), filepath.Base(bin))
+	name := filepath.Base(bin)
+	sym := filepath.Join(cmd.getConfig().BinPath(), name)
 	if *cmd.getVerboseOpts().getVerbose() {
 		fmt.Fprintf(cmd.getOuts(), "Symlink: %s -> %s\n", sym, exe)
 	}
 	if _, err := os.Stat(sym); !os.IsNotExist(err) {
 		fmt.Fprintf(cmd.getErrs(), "Warning! Can't create link of %s which already exists\n", exe)
-		return ErrWarning
+		return name, ErrWarning
 	}
 	if err := os.Symlink(exe, sym); err != nil {
+		if os.IsExist(err) {
+			// Created by another package in parallel
+			fmt.Fprintf(cmd.getErrs(), "Warning! Can't create link of %s which already exists\n", exe)
+			return name, ErrWarning
+		}
 		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
-		return ErrOperationFailed
+		return name, ErrOperationFailed
 	}
-	return nil
+	return name, nil
 }
 
 func isExecutable(mode os.FileMode) bool {
 	return mode&0111 != 0
 }
+
+// packageFile returns path of a file in a package. It is false if the path goes out of the package
+func packageFile(pkgPath, file string) (string, bool) {
+	path := filepath.Join(pkgPath, file)
+	rel, err := filepath.Rel(pkgPath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// HandleSignals makes SIGINT and SIGTERM cancel running operations instead of terminating the
+// process at once, so that child git processes are killed and partial files are cleaned up.
+// Second signal terminates the process without cleanup. It returns function to stop handling
+func (c *Cli) HandleSignals() func() {
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.ctx = ctx
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-sigs
+		if !ok {
+			return
+		}
+		fmt.Fprintf(c.errWriter, "\nReceived %s. Cleaning up ...\n", sig)
+		cancel()
+		if _, ok = <-sigs; ok {
+			fmt.Fprintln(c.errWriter, "Aborted")
+			os.Exit(130)
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+		cancel()
+	}
+}
+
+// interrupted tells whether the command is interrupted by signal
+func interrupted(cmd runner) bool {
+	return cmd.getContext().Err() != nil
+}
+
+// confirm asks user whether to proceed, reading the answer from in. Default answer is yes.
+// Reading is abandoned when the command is interrupted, so that later input doesn't proceed
+func confirm(cmd runner, in io.Reader) (bool, error) {
+	fmt.Fprint(cmd.getOuts(), "\nOkay? (Y/n) ")
+	answer := make(chan string, 1)
+	go func() {
+		stdin := bufio.NewScanner(in)
+		stdin.Scan()
+		answer <- stdin.Text()
+	}()
+
+	select {
+	case input := <-answer:
+		if interrupted(cmd) {
+			return false, ErrInterrupted
+		}
+		if strings.HasPrefix(input, "n") || strings.HasPrefix(input, "N") {
+			fmt.Fprintln(cmd.getOuts(), "Canceled")
+			return false, nil
+		}
+		return true, nil
+	case <-cmd.getContext().Done():
+		fmt.Fprintln(cmd.getOuts())
+		return false, ErrInterrupted
+	}
+}
+
+// removeStaleFiles removes temporary directories and unfinished generations left by shelp which
+// crashed or was killed. It must be called while holding exclusive lock on SHELP_ROOT
+func removeStaleFiles(cmd verboseRunner) {
+	cfg := cmd.getConfig()
+	remove := func(path, what string) {
+		if err := os.RemoveAll(path); err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Warning! Can't remove %s. Error = %v\n", path, err)
+			return
+		}
+		fmt.Fprintf(cmd.getErrs(), "Removed %s left by interrupted shelp: %s\n", what, path)
+	}
+
+	if files, err := ioutil.ReadDir(cfg.TempPath()); err == nil {
+		for _, file := range files {
+			remove(filepath.Join(cfg.TempPath(), file.Name()), "temporary files")
+		}
+	}
+
+	gens, err := listGenerations(cfg)
+	if err != nil {
+		return
+	}
+	for _, gen := range gens {
+		if gen.Current {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(gen.dir, generationBuildingFile)); err == nil {
+			remove(gen.dir, fmt.Sprintf("unfinished generation %d", gen.Number))
+		}
+	}
+}
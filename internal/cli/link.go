@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"text/template"
+	"time"
 )
 
 type linkCmd struct {
@@ -48,6 +49,12 @@ func (cmd *linkCmd) parseAndExec(args []string) error {
 		return err
 	}
 
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	src := cmd.flags.Arg(0)
 	if _, err := os.Stat(src); os.IsNotExist(err) {
 		fmt.Fprintf(cmd.errs, "Error! \"%s\" does not exist\n", src)
@@ -60,9 +67,11 @@ func (cmd *linkCmd) parseAndExec(args []string) error {
 	}
 	base := filepath.Base(path)
 
-	if err = prepareInstallDirectories(cmd.config); err != nil {
-		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
-		return ErrOperationFailed
+	if !isDryRun(cmd) {
+		if err = prepareInstallDirectories(cmd.config); err != nil {
+			fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+			return ErrOperationFailed
+		}
 	}
 
 	var pkg string
@@ -85,18 +94,41 @@ func (cmd *linkCmd) parseAndExec(args []string) error {
 		return ErrArgument
 	}
 
+	if isDryRun(cmd) {
+		wouldDo(cmd, "symlink %s -> %s", pkgPath, path)
+		wouldDo(cmd, "symlink executables of %s into %s", pkgPath, cmd.config.BinPath())
+		wouldDo(
+			cmd, "symlink completions and man pages of %s into %s", pkgPath, cmd.config.SharePath())
+		return nil
+	}
+
 	if err = os.Symlink(path, pkgPath); err != nil {
 		fmt.Fprintf(cmd.errs, "Error! %s\n", err)
 		return ErrOperationFailed
 	}
 
-	binPath := filepath.Join(pkgPath, "bin")
-	var linkErr error
-	if _, err := os.Stat(binPath); err == nil {
-		linkErr = createLinksByBinDir(cmd, binPath)
-	} else {
-		linkErr = createLinksByBinDir(cmd, pkgPath)
+	manifest := loadPackageManifest(cmd, pkg, pkgPath)
+	bins, linkErr := linkPackageBins(cmd, pkgPath, manifest.Bin)
+	completions, man, shareErr := linkPackageShare(cmd, pkgPath, manifest)
+	if linkErr == nil {
+		linkErr = shareErr
+	}
+	rc := receipt{
+		Name:        pkg,
+		Mode:        modeLink,
+		From:        path,
+		Bins:        bins,
+		Completions: completions,
+		Man:         man,
+		Source:      manifest.Source,
+		Shells:      manifest.Shells,
 	}
+	rc.InstalledAt = time.Now()
+	rc.UpdatedAt = rc.InstalledAt
+	if err = rc.save(cmd); err != nil {
+		return err
+	}
+
 	if linkErr != nil {
 		fmt.Fprintf(cmd.errs, "\"%s\" is linked as package \"%s\", but with some failures\n", src, pkg)
 		return linkErr
@@ -2,16 +2,20 @@ package cli
 
 import (
 	"fmt"
+
+	"github.com/progrhyme/shelp/internal/git"
 )
 
 type listCmd struct {
-	verboseCmd
+	gitCmd
 }
 
-func newListCmd(common commonCmd) listCmd {
+func newListCmd(common commonCmd, git git.Backend) listCmd {
 	cmd := &listCmd{}
 	cmd.commonCmd = common
+	cmd.git = git
 	setupCmdFlags(cmd, "list", cmd.usage)
+	setupOutputFlag(cmd)
 	return *cmd
 }
 
@@ -20,7 +24,9 @@ func (cmd *listCmd) usage() {
   List installed packages.
 
 Syntax:
-  %s list
+  %s list [-v|--verbose]
+
+With "-v|--verbose" option, it shows how each package is installed as well.
 
 Options:
 `, cmd.name)
@@ -33,13 +39,46 @@ func (cmd *listCmd) parseAndExec(args []string) error {
 		return err
 	}
 
+	unlock, err := lockRoot(cmd, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if isJSONOutput(cmd) {
+		out := cmd.divertOuts()
+		pkgs, err := installedPackages(cmd, false)
+		records := []packageRecord{}
+		for _, pkg := range pkgs {
+			status := statusInstalled
+			if isLinkedPackage(cmd, pkg.Name()) {
+				status = statusLinked
+			}
+			records = append(records, recordOf(cmd, pkg.Name(), status))
+		}
+		return printJSONResult(cmd, out, records, err)
+	}
+
 	pkgs, err := installedPackages(cmd, false)
 	if err != nil {
 		return err
 	}
 
 	for _, pkg := range pkgs {
-		fmt.Fprintln(cmd.outs, pkg.Name())
+		if !*cmd.option.verbose {
+			fmt.Fprintln(cmd.outs, pkg.Name())
+			continue
+		}
+
+		rc, ok := loadReceipt(cmd.config, pkg.Name())
+		switch {
+		case !ok:
+			fmt.Fprintf(cmd.outs, "%s\t(no receipt)\n", pkg.Name())
+		case rc.Mode == modeLink:
+			fmt.Fprintf(cmd.outs, "%s\t%s -> %s\n", pkg.Name(), rc.Mode, rc.From)
+		default:
+			fmt.Fprintf(cmd.outs, "%s\t%s %s@%s %s\n", pkg.Name(), rc.Mode, rc.URL, rc.Ref, shortCommit(rc.Commit))
+		}
 	}
 
 	return nil
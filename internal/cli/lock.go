@@ -0,0 +1,191 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockPollInterval is the interval to retry taking the lock held by another process
+const lockPollInterval = 200 * time.Millisecond
+
+// rootLock is an advisory lock on SHELP_ROOT. Mutating commands take it exclusively, and read-only
+// commands take it shared
+type rootLock struct {
+	path      string
+	exclusive bool
+	file      *os.File
+	// Path of pid file used instead on filesystems which don't support file locking
+	pidFile string
+}
+
+// lockHolder is a process which holds the lock exclusively
+type lockHolder struct {
+	pid     int
+	command string
+}
+
+func (h lockHolder) String() string {
+	if h.pid == 0 {
+		return "another process"
+	}
+	s := fmt.Sprintf("pid %d", h.pid)
+	if h.command != "" {
+		s += fmt.Sprintf(" (%s)", h.command)
+	}
+	return s
+}
+
+// lockRoot takes the lock on SHELP_ROOT for the command and returns function to release it.
+// Commands in dry-run mode take shared lock as they don't change anything
+// Files left by interrupted process are cleaned up with exclusive lock, and compiled init scripts
+// are updated on its release
+func lockRoot(cmd verboseRunner, exclusive bool) (func(), error) {
+	exclusive = exclusive && !isDryRun(cmd)
+	unlock, err := lockRootFor(cmd, exclusive, *cmd.getVerboseOpts().getWait())
+	if err != nil || !exclusive {
+		return unlock, err
+	}
+	removeStaleFiles(cmd)
+	return func() {
+		recompileInitScripts(cmd)
+		unlock()
+	}, nil
+}
+
+// lockRootFor takes the lock waiting for another process to release it up to given duration
+func lockRootFor(cmd runner, exclusive bool, wait time.Duration) (func(), error) {
+	root := cmd.getConfig().RootPath()
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		if !exclusive {
+			// Nothing to read
+			return func() {}, nil
+		}
+		if err = os.MkdirAll(root, 0755); err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+			return nil, ErrOperationFailed
+		}
+	}
+
+	lock := &rootLock{path: cmd.getConfig().RootLockFile(), exclusive: exclusive}
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		holder, err := lock.tryLock()
+		if err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Error! Can't lock %s. Error = %v\n", lock.path, err)
+			return nil, ErrOperationFailed
+		}
+		if holder == nil {
+			return lock.unlock, nil
+		}
+
+		if time.Now().After(deadline) {
+			fmt.Fprintf(
+				cmd.getErrs(), "Error! %s is locked by %s. Use \"--wait\" option to wait for it\n",
+				root, holder)
+			return nil, ErrLocked
+		}
+		if !waiting {
+			fmt.Fprintf(cmd.getErrs(), "Waiting for %s to release the lock ...\n", holder)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// tryLock takes the lock without blocking. It returns the holder when the lock is taken by another
+// process
+func (lock *rootLock) tryLock() (*lockHolder, error) {
+	if lock.pidFile != "" {
+		return lock.tryPidFile()
+	}
+	if lock.file == nil {
+		file, err := os.OpenFile(lock.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		lock.file = file
+	}
+
+	busy, err := flock(lock.file, lock.exclusive)
+	if err == errLockUnsupported {
+		lock.file.Close()
+		lock.file = nil
+		lock.pidFile = lock.path + ".pid"
+		return lock.tryPidFile()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if busy {
+		holder := readLockHolder(lock.path)
+		return &holder, nil
+	}
+	if lock.exclusive {
+		// Record holder for other processes waiting for the lock
+		lock.file.Truncate(0)
+		lock.file.WriteAt([]byte(lockHolderInfo()), 0)
+	}
+	return nil, nil
+}
+
+// tryPidFile takes the lock by creating pid file exclusively. Pid file of dead process is stale
+// and removed
+func (lock *rootLock) tryPidFile() (*lockHolder, error) {
+	file, err := os.OpenFile(lock.pidFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		_, err = file.WriteString(lockHolderInfo())
+		file.Close()
+		return nil, err
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+
+	holder := readLockHolder(lock.pidFile)
+	if holder.pid > 0 && !processAlive(holder.pid) {
+		// Stale lock left by crashed process
+		if err = os.Remove(lock.pidFile); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return lock.tryPidFile()
+	}
+	return &holder, nil
+}
+
+func (lock *rootLock) unlock() {
+	if lock.pidFile != "" {
+		os.Remove(lock.pidFile)
+		return
+	}
+	if lock.exclusive {
+		lock.file.Truncate(0)
+	}
+	funlock(lock.file)
+	lock.file.Close()
+}
+
+// lockHolderInfo returns contents of lock file which tell the current process
+func lockHolderInfo() string {
+	return fmt.Sprintf("%d\n%s\n", os.Getpid(), strings.Join(os.Args, " "))
+}
+
+func readLockHolder(path string) lockHolder {
+	holder := lockHolder{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return holder
+	}
+	lines := strings.SplitN(string(data), "\n", 3)
+	if pid, err := strconv.Atoi(strings.TrimSpace(lines[0])); err == nil {
+		holder.pid = pid
+	}
+	if len(lines) > 1 {
+		holder.command = strings.TrimSpace(lines[1])
+	}
+	return holder
+}
@@ -0,0 +1,40 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package cli
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errLockUnsupported = errors.New("File locking is not supported")
+
+// flock locks the file without blocking. It returns true when another process holds the lock
+func flock(file *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	switch err {
+	case nil:
+		return false, nil
+	case syscall.EWOULDBLOCK:
+		return true, nil
+	case syscall.ENOLCK, syscall.EOPNOTSUPP:
+		return false, errLockUnsupported
+	default:
+		return false, err
+	}
+}
+
+func funlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,26 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package cli
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockUnsupported = errors.New("File locking is not supported")
+
+// flock always fails so that pid file is used instead
+func flock(file *os.File, exclusive bool) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func funlock(file *os.File) error {
+	return nil
+}
+
+func processAlive(pid int) bool {
+	// Not found process can't be opened on Windows. Other platforms assume it is alive
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
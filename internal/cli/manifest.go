@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/progrhyme/shelp/internal/config"
+)
+
+// loadPackageManifest reads manifest file of a package and checks requirements declared in it.
+// It returns empty manifest when the package has no manifest or it is broken
+func loadPackageManifest(cmd verboseRunner, name, pkgPath string) config.Manifest {
+	manifest, ok, err := config.LoadManifest(pkgPath)
+	if err != nil {
+		fmt.Fprintf(
+			cmd.getErrs(), "Warning! Can't load %s of \"%s\". Ignored. Error = %v\n",
+			config.ManifestFileName, name, err)
+		return config.Manifest{}
+	}
+	if !ok {
+		return manifest
+	}
+	if *cmd.getVerboseOpts().getVerbose() {
+		path := filepath.Join(pkgPath, config.ManifestFileName)
+		fmt.Fprintf(cmd.getErrs(), "[Info] Use manifest: %s\n", path)
+	}
+
+	for _, command := range manifest.Requires {
+		if _, err := exec.LookPath(command); err != nil {
+			fmt.Fprintf(
+				cmd.getErrs(), "Warning! \"%s\" requires command \"%s\" which is not found\n",
+				name, command)
+		}
+	}
+	if shell := filepath.Base(os.Getenv("SHELL")); len(manifest.Shells) > 0 && shell != "." {
+		supported := false
+		for _, sh := range manifest.Shells {
+			if sh == shell {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			fmt.Fprintf(
+				cmd.getErrs(), "Warning! \"%s\" supports only shells: %s. Current shell is %s\n",
+				name, strings.Join(manifest.Shells, ", "), shell)
+		}
+	}
+
+	return manifest
+}
@@ -2,8 +2,7 @@ package cli
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
 	"text/template"
 
 	"github.com/progrhyme/shelp/internal/git"
@@ -11,13 +10,16 @@ import (
 
 type outdatedCmd struct {
 	gitCmd
+	refresh *bool
 }
 
-func newOutdatedCmd(common commonCmd, git git.Git) outdatedCmd {
+func newOutdatedCmd(common commonCmd, git git.Backend) outdatedCmd {
 	cmd := &outdatedCmd{}
 	cmd.commonCmd = common
 	cmd.git = git
 	setupCmdFlags(cmd, "outdated", cmd.usage)
+	setupOutputFlag(cmd)
+	cmd.refresh = cmd.flags.Bool("refresh", false, "# Check remote repositories ignoring cache")
 	return *cmd
 }
 
@@ -29,6 +31,10 @@ Syntax:
   {{.Prog}} {{.Cmd}}
 
 To update a package, run "{{.Prog}} upgrade [<package>]".
+Packages rolled back by "rollback" command are shown with the commit they are pinned to.
+
+Packages are checked by "git ls-remote" in parallel, without fetching into them.
+Results are cached for "outdated.ttl" in config file, which is 10 minutes by default.
 
 Options:
 `
@@ -45,51 +51,89 @@ func (cmd *outdatedCmd) parseAndExec(args []string) error {
 		return err
 	}
 
-	pkgs, err := installedPackages(cmd, true)
+	unlock, err := lockRoot(cmd, false)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	var out io.Writer
+	if isJSONOutput(cmd) {
+		out = cmd.divertOuts()
+	}
+
+	records, err := cmd.checkAll()
+	if out != nil {
+		return printJSONResult(cmd, out, records, err)
+	}
+	return err
+}
+
+// checkAll checks updates of all packages and returns the results
+func (cmd *outdatedCmd) checkAll() ([]packageRecord, error) {
+	records := []packageRecord{}
+	pkgs, err := installedPackages(cmd, true)
+	if err != nil {
+		return records, err
+	}
 
+	names := []string{}
 	for _, pkg := range pkgs {
-		old, err := hasPackageUpdate(cmd, pkg.Name())
+		if _, pinned := isPinned(cmd, pkg.Name()); !pinned {
+			names = append(names, pkg.Name())
+		}
+	}
+	results := checkUpdates(cmd, names, !*cmd.refresh)
+
+	checked := 0
+	for _, pkg := range pkgs {
+		if rc, pinned := isPinned(cmd, pkg.Name()); pinned {
+			fmt.Fprintf(cmd.outs, "%s (rolled back to %s)\n", pkg.Name(), shortCommit(rc.Commit))
+			records = append(records, recordOf(cmd, pkg.Name(), statusPinned))
+			continue
+		}
+
+		old, err := results[checked].outdated, results[checked].err
+		checked++
 		switch err {
 		case nil:
 			// do nothing
-		case ErrOperationFailed:
-			return err
+		case ErrOperationFailed, ErrInterrupted:
+			failed := packageRecord{Name: pkg.Name(), Status: statusFailed, Error: err.Error()}
+			return append(records, failed), err
 		default:
-			return ErrCommandFailed
+			failed := packageRecord{Name: pkg.Name(), Status: statusFailed, Error: err.Error()}
+			return append(records, failed), ErrCommandFailed
 		}
 
+		status := statusUpToDate
+		if isLinkedPackage(cmd, pkg.Name()) {
+			status = statusLinked
+		}
 		if old {
+			status = statusOutdated
 			fmt.Fprintln(cmd.outs, pkg.Name())
 		} else {
 			if *cmd.option.verbose {
 				fmt.Fprintf(cmd.errs, "%s is up-to-date\n", pkg.Name())
 			}
 		}
+		records = append(records, recordOf(cmd, pkg.Name(), status))
 	}
 
-	return nil
+	return records, nil
 }
 
 func hasPackageUpdate(cmd gitRunner, name string) (bool, error) {
-	path := filepath.Join(cmd.getConfig().PackagePath(), name)
 	if *cmd.getVerboseOpts().getVerbose() {
 		fmt.Fprintf(cmd.getErrs(), "[Info] Checking %s ...\n", name)
 	}
-	if isSymlink(path, cmd.getErrs()) {
+	if isLinkedPackage(cmd, name) {
 		if *cmd.getVerboseOpts().getVerbose() {
 			fmt.Fprintln(cmd.getErrs(), "[Info] Symbolic link. Skip")
 		}
 		return false, nil
 	}
 
-	pwd, err := chdir(cmd, path)
-	if err != nil {
-		return false, ErrOperationFailed
-	}
-	defer os.Chdir(pwd)
-
-	return cmd.getGit().HasUpdate(*cmd.getVerboseOpts().getVerbose())
+	return checkUpdate(cmd, name)
 }
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Formats for "--output" option
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Status of a package in machine-readable output
+const (
+	statusInstalled = "installed"
+	statusLinked    = "linked"
+	statusUpToDate  = "up-to-date"
+	statusOutdated  = "outdated"
+	statusWarning   = "warning"
+	statusSkipped   = "skipped"
+	statusClean     = "clean"
+	statusModified  = "modified"
+	statusPinned    = "pinned"
+	statusFailed    = "failed"
+)
+
+// packageRecord is a result of a command for one package in machine-readable output
+type packageRecord struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// commandResult is the whole result of a command in machine-readable output
+type commandResult struct {
+	Result   string          `json:"result"`
+	Error    string          `json:"error,omitempty"`
+	Packages []packageRecord `json:"packages"`
+}
+
+func isJSONOutput(cmd helpRunner) bool {
+	output := cmd.getOpts().getOutput()
+	return output != nil && *output == outputJSON
+}
+
+// printJSONResult writes records of packages and overall result derived from err into out
+func printJSONResult(cmd runner, out io.Writer, records []packageRecord, err error) error {
+	result := commandResult{Result: "ok", Packages: records}
+	if result.Packages == nil {
+		result.Packages = []packageRecord{}
+	}
+	switch err {
+	case nil:
+		// OK
+	case ErrWarning:
+		result.Result = "warning"
+	case ErrCanceled:
+		result.Result = "canceled"
+	default:
+		result.Result = "error"
+		result.Error = err.Error()
+	}
+
+	data, e := json.MarshalIndent(result, "", "  ")
+	if e != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", e)
+		return ErrOperationFailed
+	}
+	fmt.Fprintln(out, string(data))
+	return err
+}
+
+// recordOf makes a record of installed package
+func recordOf(cmd gitRunner, name, status string) packageRecord {
+	record := packageRecord{Name: name, Status: status}
+	if pkg, err := packageInstalled(cmd, filepath.Join(cmd.getConfig().PackagePath(), name)); err == nil {
+		record.URL = pkg.url
+		record.Ref = pkg.ref
+		record.Commit = pkg.commit
+	}
+	return record
+}
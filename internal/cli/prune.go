@@ -1,10 +1,9 @@
 package cli
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -48,7 +47,7 @@ func (cmd *pruneCmd) usage() {
   Uninstall packages not defined in config file.
 
 Syntax:
-  {{.Prog}} {{.Cmd}} [-c|--config CONFIG] [-y|--yes] [--link]
+  {{.Prog}} {{.Cmd}} [-c|--config CONFIG] [-y|--yes] [--link] [--dry-run]
 
 This doesn't remove symlinks created with "link" command by default.
 To remove them, specify "--link" option.
@@ -67,6 +66,12 @@ func (cmd *pruneCmd) parseAndExec(args []string) error {
 		return err
 	}
 
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	founds, err := installedPackages(cmd, true)
 	if err != nil {
 		return err
@@ -75,13 +80,22 @@ func (cmd *pruneCmd) parseAndExec(args []string) error {
 
 	skipped := 0
 	for _, fi := range founds {
-		path := filepath.Join(cmd.config.PackagePath(), fi.Name())
+		if dependents := dependentsOf(cmd, fi.Name()); len(dependents) > 0 {
+			if *cmd.option.verbose {
+				fmt.Fprintf(
+					cmd.errs, "\"%s\" is required by %s. Skip\n",
+					fi.Name(), strings.Join(dependents, ", "))
+			}
+			skipped++
+			continue
+		}
+
 		if *cmd.option.link {
 			candidates[fi.Name()] = prunee
 			continue
 		}
 
-		if isSymlink(path, cmd.errs) {
+		if isLinkedPackage(cmd, fi.Name()) {
 			if *cmd.option.verbose {
 				fmt.Fprintf(cmd.errs, "\"%s\" is symlink. Skip\n", fi.Name())
 			}
@@ -125,20 +139,20 @@ func (cmd *pruneCmd) parseAndExec(args []string) error {
 		}
 		prunees = append(prunees, name)
 	}
+	sort.Strings(prunees)
 
-	if isatty.IsTerminal(os.Stdin.Fd()) && !*cmd.option.yes {
-		const confirmation = `Packages to remove:
+	const list = `Packages to remove:
 {{- range $i, $name := .Packages}}
   {{$name}}{{end}}
-
-Okay? (Y/n) `
-		t := template.Must(template.New("usage").Parse(confirmation))
+`
+	t := template.Must(template.New("list").Parse(list))
+	if isDryRun(cmd) {
+		t.Execute(cmd.outs, struct{ Packages []string }{prunees})
+	} else if isatty.IsTerminal(os.Stdin.Fd()) && !*cmd.option.yes {
 		t.Execute(cmd.outs, struct{ Packages []string }{prunees})
-		stdin := bufio.NewScanner(os.Stdin)
-		stdin.Scan()
-		input := stdin.Text()
-		if strings.HasPrefix(input, "n") || strings.HasPrefix(input, "N") {
-			fmt.Fprintln(cmd.outs, "Canceled")
+		if ok, err := confirm(cmd, os.Stdin); err != nil {
+			return err
+		} else if !ok {
 			return ErrCanceled
 		}
 	}
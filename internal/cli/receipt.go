@@ -0,0 +1,165 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/progrhyme/shelp/internal/config"
+)
+
+// How a package is installed
+const (
+	modeInstall = "install"
+	modeBundle  = "bundle"
+	modeLink    = "link"
+)
+
+// receipt records what shelp installed for a package
+type receipt struct {
+	Name          string    `json:"name"`
+	Mode          string    `json:"mode"`
+	From          string    `json:"from"`
+	At            string    `json:"at,omitempty"`
+	URL           string    `json:"url,omitempty"`
+	Ref           string    `json:"ref,omitempty"`
+	Commit        string    `json:"commit,omitempty"`
+	Constraint    string    `json:"constraint,omitempty"`
+	TracksDefault bool      `json:"tracks_default,omitempty"`
+	Shallow       bool      `json:"shallow,omitempty"`
+	Bins          []string  `json:"bins"`
+	Completions   []string  `json:"completions,omitempty"`
+	Man           []string  `json:"man,omitempty"`
+	Source        []string  `json:"source,omitempty"`
+	Shells        []string  `json:"shells,omitempty"`
+	Depends       []string  `json:"depends,omitempty"`
+	History       []state   `json:"history,omitempty"`
+	Pin           *pin      `json:"pin,omitempty"`
+	InstalledAt   time.Time `json:"installed_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// historyLimit is the number of previous states of a package kept in its receipt
+const historyLimit = 10
+
+// state is a previous state of a package recorded on upgrade or re-install
+type state struct {
+	URL        string    `json:"url,omitempty"`
+	Ref        string    `json:"ref,omitempty"`
+	Commit     string    `json:"commit"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// pin tells a package is rolled back. Upgrading the package releases it
+type pin struct {
+	// Commit which the package is rolled back from
+	From string `json:"from"`
+	// Ref which the package tracked before rollback
+	Ref string `json:"ref,omitempty"`
+}
+
+// recordPrevious adds state of the package before update into its history. The newest comes first
+func (rc *receipt) recordPrevious(prev receipt) {
+	if prev.Commit == "" || prev.Commit == rc.Commit {
+		return
+	}
+	history := []state{{URL: prev.URL, Ref: prev.Ref, Commit: prev.Commit, ReplacedAt: time.Now()}}
+	for _, st := range prev.History {
+		if st.Commit != rc.Commit && st.Commit != prev.Commit && len(history) < historyLimit {
+			history = append(history, st)
+		}
+	}
+	rc.History = history
+}
+
+func receiptFile(cfg *config.Config, name string) string {
+	return filepath.Join(cfg.ReceiptPath(), name+".json")
+}
+
+// loadReceipt returns receipt of the package. It returns false when the package has no receipt;
+// e.g. it is installed by older version of shelp
+func loadReceipt(cfg *config.Config, name string) (receipt, bool) {
+	rc := receipt{}
+	data, err := ioutil.ReadFile(receiptFile(cfg, name))
+	if err != nil {
+		return rc, false
+	}
+	if err = json.Unmarshal(data, &rc); err != nil {
+		return rc, false
+	}
+	return rc, true
+}
+
+func (rc *receipt) save(cmd runner) error {
+	if err := os.MkdirAll(cmd.getConfig().ReceiptPath(), 0755); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	data, err := json.MarshalIndent(rc, "", "  ")
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	path := receiptFile(cmd.getConfig(), rc.Name)
+	if err = ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Writing receipt failed. Path = %s, Error = %v\n", path, err)
+		return ErrOperationFailed
+	}
+	return nil
+}
+
+func deleteReceipt(cmd runner, name string) error {
+	path := receiptFile(cmd.getConfig(), name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(cmd.getErrs(), "Error! Deleting receipt failed. Path = %s, Error = %v\n", path, err)
+		return ErrOperationFailed
+	}
+	return nil
+}
+
+// isLinkedPackage tells whether the package is pseudo one created by "link" command
+func isLinkedPackage(cmd runner, name string) bool {
+	if rc, ok := loadReceipt(cmd.getConfig(), name); ok {
+		return rc.Mode == modeLink
+	}
+	return isSymlink(filepath.Join(cmd.getConfig().PackagePath(), name), cmd.getErrs())
+}
+
+// refreshReceipt records current commit of a package after its working tree is updated. Links of
+// completions and man pages and contents of manifest are renewed as they may be changed by the
+// update
+func refreshReceipt(cmd gitRunner, name string) error {
+	rc, ok := loadReceipt(cmd.getConfig(), name)
+	if !ok {
+		return nil
+	}
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	repo, err := cmd.getGit().Worktree(path, *cmd.getVerboseOpts().getVerbose())
+	if err != nil {
+		return ErrOperationFailed
+	}
+	shared := receipt{Completions: rc.Completions, Man: rc.Man}
+	if err = removeReceiptLinks(cmd, shared, path); err != nil {
+		return ErrOperationFailed
+	}
+	manifest := loadPackageManifest(cmd, name, path)
+	completions, man, linkErr := linkPackageShare(cmd, path, manifest)
+
+	prev := rc
+	rc.Ref = repo.BranchOrTag()
+	rc.Commit = repo.Commit
+	rc.Completions = completions
+	rc.Man = man
+	rc.Source = manifest.Source
+	rc.Shells = manifest.Shells
+	rc.Pin = nil
+	rc.recordPrevious(prev)
+	rc.UpdatedAt = time.Now()
+	if err = rc.save(cmd); err != nil {
+		return err
+	}
+	return linkErr
+}
@@ -12,12 +12,14 @@ import (
 type removeCmd struct {
 	verboseCmd
 	command string
+	force   *bool
 }
 
 func newRemoveCmd(common commonCmd) removeCmd {
 	cmd := &removeCmd{}
 	cmd.commonCmd = common
 	setupCmdFlags(cmd, "remove", nil)
+	cmd.force = cmd.flags.BoolP("force", "f", false, "# Remove even if other packages depend on it")
 	return *cmd
 }
 
@@ -26,7 +28,9 @@ func (cmd *removeCmd) usage() {
   Uninstall a package clearing symlinks of executable files if they exist.
 
 Syntax:
-  {{.Prog}} {{.Cmd}} <package>
+  {{.Prog}} {{.Cmd}} [-f|--force] <package>
+
+It refuses to remove a package which other packages depend on unless "-f|--force" is specified.
 
 Examples:
   {{.Prog}} {{.Cmd}} bats-core
@@ -50,7 +54,21 @@ func (cmd *removeCmd) parseAndExec(args []string) error {
 		return err
 	}
 
-	return removePackage(cmd, cmd.flags.Arg(0), false)
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	name := cmd.flags.Arg(0)
+	if dependents := dependentsOf(cmd, name); len(dependents) > 0 && !*cmd.force {
+		fmt.Fprintf(
+			cmd.errs, "Error! \"%s\" is required by %s. Use \"--force\" to remove anyway\n",
+			name, strings.Join(dependents, ", "))
+		return ErrOperationFailed
+	}
+
+	return removePackage(cmd, name, false)
 }
 
 func removePackage(cmd verboseRunner, name string, silent bool) error {
@@ -60,21 +78,67 @@ func removePackage(cmd verboseRunner, name string, silent bool) error {
 		return ErrArgument
 	}
 
-	if err := removeBinsLinks(cmd, path); err != nil {
+	if rc, ok := loadReceipt(cmd.getConfig(), name); ok {
+		if err := removeReceiptLinks(cmd, rc, path); err != nil {
+			return ErrOperationFailed
+		}
+	} else if err := removeBinsLinks(cmd, path); err != nil {
 		return ErrOperationFailed
 	}
 
+	if isDryRun(cmd) {
+		wouldDo(cmd, "remove %s", path)
+		return nil
+	}
+
 	if err := os.RemoveAll(path); err != nil {
 		fmt.Fprintf(cmd.getErrs(), "Error! Package removal failed. Path = %s\n", path)
 		return ErrOperationFailed
 	}
 
+	if err := deleteReceipt(cmd, name); err != nil {
+		return err
+	}
+
 	if !silent {
 		fmt.Fprintf(cmd.getOuts(), "\"%s\" is removed\n", name)
 	}
 	return nil
 }
 
+// removeReceiptLinks deletes links of executables, completions and man pages recorded in the
+// receipt of a package
+func removeReceiptLinks(cmd verboseRunner, rc receipt, pkgPath string) error {
+	syms := []string{}
+	for _, bin := range rc.Bins {
+		syms = append(syms, filepath.Join(cmd.getConfig().BinPath(), bin))
+	}
+	for _, file := range append(append([]string{}, rc.Completions...), rc.Man...) {
+		syms = append(syms, filepath.Join(cmd.getConfig().SharePath(), file))
+	}
+
+	for _, sym := range syms {
+		src, err := os.Readlink(sym)
+		if err != nil || !isInPackage(src, pkgPath) {
+			// Already removed or replaced by another package
+			continue
+		}
+		if isDryRun(cmd) {
+			wouldDo(cmd, "delete %s -> %s", sym, src)
+			continue
+		}
+		if *cmd.getVerboseOpts().getVerbose() {
+			fmt.Fprintf(cmd.getOuts(), "Delete %s -> %s\n", sym, src)
+		}
+		if err = os.Remove(sym); err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Error! Deletion failed: %s. Error = %s\n", sym, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBinsLinks deletes links into a package which has no receipt
 func removeBinsLinks(cmd verboseRunner, pkgPath string) error {
 	binPath := cmd.getConfig().BinPath()
 	bins, err := ioutil.ReadDir(binPath)
@@ -90,7 +154,11 @@ func removeBinsLinks(cmd verboseRunner, pkgPath string) error {
 			fmt.Fprintf(cmd.getErrs(), "Warning! Failed to read link of %s. Error = %s\n", sym, err)
 			continue
 		}
-		if strings.HasPrefix(src, pkgPath) {
+		if isInPackage(src, pkgPath) {
+			if isDryRun(cmd) {
+				wouldDo(cmd, "delete %s -> %s", sym, src)
+				continue
+			}
 			if *cmd.getVerboseOpts().getVerbose() {
 				fmt.Fprintf(cmd.getOuts(), "Delete %s -> %s\n", sym, src)
 			}
@@ -103,3 +171,7 @@ func removeBinsLinks(cmd verboseRunner, pkgPath string) error {
 
 	return nil
 }
+
+func isInPackage(path, pkgPath string) bool {
+	return strings.HasPrefix(path, pkgPath+string(filepath.Separator))
+}
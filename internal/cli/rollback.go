@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/progrhyme/shelp/internal/git"
+)
+
+type rollbackCmd struct {
+	gitCmd
+	to         *string
+	force      *bool
+	generation *int
+}
+
+func newRollbackCmd(common commonCmd, git git.Backend) rollbackCmd {
+	cmd := &rollbackCmd{}
+	cmd.commonCmd = common
+	cmd.git = git
+	setupCmdFlags(cmd, "rollback", cmd.usage)
+	cmd.to = cmd.flags.String("to", "", "# Commit hash or number of steps back in history")
+	cmd.force = cmd.flags.Bool("force", false, "# Discard local changes before rollback")
+	cmd.generation = cmd.flags.Int("generation", 0, "# Switch all packages to the generation")
+	return *cmd
+}
+
+func (cmd *rollbackCmd) usage() {
+	const help = `Summary:
+  Roll back a package to the commit installed before its upgrade or re-install.
+  Or switch all packages back to a generation.
+
+Syntax:
+  # Roll back to the previous commit
+  {{.Prog}} {{.Cmd}} <package>
+
+  # Roll back to a commit in history, or 2 steps back
+  {{.Prog}} {{.Cmd}} <package> --to <commit>
+  {{.Prog}} {{.Cmd}} <package> --to 2
+
+  # Switch to a generation listed by "generations" command
+  {{.Prog}} {{.Cmd}} --generation <number>
+
+Previous commits of a package are recorded on "upgrade", "bundle" and "sync". "info" command shows
+them. Executables of the package are linked again after rollback.
+
+The package is pinned to the commit; "upgrade" skips it until it is upgraded by name.
+
+Options:
+`
+
+	t := template.Must(template.New("usage").Parse(help))
+	t.Execute(cmd.errs, struct{ Prog, Cmd string }{cmd.name, "rollback"})
+
+	cmd.flags.PrintDefaults()
+}
+
+func (cmd *rollbackCmd) parseAndExec(args []string) error {
+	done, err := parseStart(cmd, args, false, false)
+	if done || err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if *cmd.generation > 0 {
+		return cmd.switchTo(*cmd.generation)
+	}
+	if cmd.flags.NArg() == 0 {
+		cmd.flags.Usage()
+		return ErrUsage
+	}
+	return cmd.rollback(cmd.flags.Arg(0))
+}
+
+// switchTo makes the generation current
+func (cmd *rollbackCmd) switchTo(number int) error {
+	if _, err := os.Stat(generationDir(cmd.config, number)); os.IsNotExist(err) {
+		fmt.Fprintf(cmd.errs, "Generation %d does not exist\n", number)
+		return ErrArgument
+	}
+	if current, ok := currentGeneration(cmd.config); ok && current == number {
+		fmt.Fprintf(cmd.outs, "Generation %d is already current\n", number)
+		return nil
+	}
+
+	if isDryRun(cmd) {
+		wouldDo(cmd, "switch %s to generation %d", cmd.config.CurrentLink(), number)
+		return nil
+	}
+	if err := switchGeneration(cmd.config, number); err != nil {
+		fmt.Fprintf(cmd.errs, "Error! Can't switch generation. Error = %v\n", err)
+		return ErrOperationFailed
+	}
+	fmt.Fprintf(cmd.outs, "Switched to generation %d\n", number)
+	return nil
+}
+
+func (cmd *rollbackCmd) rollback(name string) error {
+	path := filepath.Join(cmd.config.PackagePath(), name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		fmt.Fprintf(cmd.errs, "\"%s\" is not installed\n", name)
+		return ErrArgument
+	}
+	if isLinkedPackage(cmd, name) {
+		fmt.Fprintf(cmd.errs, "\"%s\" is created by \"link\" and can't be rolled back\n", name)
+		return ErrArgument
+	}
+	rc, ok := loadReceipt(cmd.config, name)
+	if !ok || len(rc.History) == 0 {
+		fmt.Fprintf(cmd.errs, "No previous commit of \"%s\" is recorded\n", name)
+		return ErrArgument
+	}
+
+	target, err := cmd.target(rc)
+	if err != nil {
+		return err
+	}
+	if target.Commit == rc.Commit {
+		fmt.Fprintf(cmd.outs, "\"%s\" is already at %s\n", name, shortCommit(rc.Commit))
+		return nil
+	}
+
+	strategy := keepLocal
+	if *cmd.force {
+		strategy = forceLocal
+	}
+	if err = handleLocalChanges(cmd, name, strategy); err != nil {
+		return err
+	}
+
+	if isDryRun(cmd) {
+		wouldDo(cmd, "check out %s in %s", target.Commit, path)
+		wouldDo(cmd, "symlink executables of %s into %s", path, cmd.config.BinPath())
+		return nil
+	}
+
+	// Shallow clone doesn't have previous commits
+	if rc.Shallow || (target.URL != "" && target.URL != rc.URL) {
+		err = cmd.reinstall(rc, target)
+	} else {
+		err = cmd.checkout(rc, target)
+	}
+	if err != nil && err != ErrWarning {
+		return err
+	}
+
+	fmt.Fprintf(cmd.outs, "\"%s\" is rolled back to %s\n", name, shortCommit(target.Commit))
+	return err
+}
+
+// target finds the state to roll back to by "--to" option
+func (cmd *rollbackCmd) target(rc receipt) (state, error) {
+	to := *cmd.to
+	if to == "" {
+		return rc.History[0], nil
+	}
+
+	// Short commit hash has at least 4 digits
+	if n, err := strconv.Atoi(to); err == nil && len(to) < 4 {
+		if n < 1 || n > len(rc.History) {
+			fmt.Fprintf(
+				cmd.errs, "Error! \"%s\" has %d previous commits. Got: %d\n",
+				rc.Name, len(rc.History), n)
+			return state{}, ErrArgument
+		}
+		return rc.History[n-1], nil
+	}
+
+	for _, st := range rc.History {
+		if strings.HasPrefix(st.Commit, to) {
+			return st, nil
+		}
+	}
+	// Any commit in the repository is accepted
+	return state{URL: rc.URL, Commit: to}, nil
+}
+
+// checkout checks out the commit in working tree of the package and links its executables again
+func (cmd *rollbackCmd) checkout(rc receipt, target state) error {
+	path := filepath.Join(cmd.config.PackagePath(), rc.Name)
+	verbose := *cmd.option.verbose
+	if err := detachPackage(cmd, rc.Name); err != nil {
+		return err
+	}
+	if err := cmd.git.Checkout(path, target.Commit, verbose); err != nil {
+		fmt.Fprintf(
+			cmd.errs, "Error! Checkout failed. Package = %s, Commit = %s\n", rc.Name, target.Commit)
+		return ErrCommandFailed
+	}
+
+	if err := removeReceiptLinks(cmd, rc, path); err != nil {
+		return ErrOperationFailed
+	}
+	manifest := loadPackageManifest(cmd, rc.Name, path)
+	bins := manifest.Bin
+	if args, ok := configuredArgs(cmd, rc.Name); ok && len(args.bin) > 0 {
+		bins = args.bin
+	}
+	bins, linkErr := linkPackageBins(cmd, path, bins)
+	completions, man, shareErr := linkPackageShare(cmd, path, manifest)
+	if linkErr == nil {
+		linkErr = shareErr
+	}
+
+	prev := rc
+	repo, err := cmd.git.Worktree(path, verbose)
+	if err != nil {
+		return ErrOperationFailed
+	}
+	rc.Ref = repo.BranchOrTag()
+	rc.Commit = repo.Commit
+	rc.Bins = bins
+	rc.Completions = completions
+	rc.Man = man
+	rc.Source = manifest.Source
+	rc.Shells = manifest.Shells
+	rc.recordPrevious(prev)
+	rc.Pin = pinOf(prev)
+	rc.UpdatedAt = time.Now()
+	if err = rc.save(cmd); err != nil {
+		return err
+	}
+	return linkErr
+}
+
+// reinstall installs the package at the commit from scratch
+func (cmd *rollbackCmd) reinstall(rc receipt, target state) error {
+	args, _ := configuredArgs(cmd, rc.Name)
+	url := target.URL
+	if url == "" {
+		url = rc.URL
+	}
+	args.from = url
+	args.as = rc.Name
+	args.at = ""
+	args.commit = target.Commit
+	args.overwrite = true
+	args.strategy = forceLocal
+	args.mode = rc.Mode
+	if err := installPackage(cmd, args); err != nil && err != ErrWarning {
+		return err
+	}
+
+	// Keep how the package is specified by user
+	now, ok := loadReceipt(cmd.config, rc.Name)
+	if !ok {
+		return ErrOperationFailed
+	}
+	now.From = rc.From
+	now.At = rc.At
+	now.Constraint = rc.Constraint
+	now.Pin = pinOf(rc)
+	return now.save(cmd)
+}
+
+// pinOf makes a pin of the package rolled back from given state
+func pinOf(prev receipt) *pin {
+	p := &pin{From: prev.Commit, Ref: prev.Ref}
+	if prev.Pin != nil {
+		// Keep ref tracked before the first rollback
+		p.Ref = prev.Pin.Ref
+	}
+	return p
+}
+
+// isPinned tells whether the package is rolled back
+func isPinned(cmd runner, name string) (receipt, bool) {
+	rc, ok := loadReceipt(cmd.getConfig(), name)
+	return rc, ok && rc.Pin != nil
+}
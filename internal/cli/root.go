@@ -36,18 +36,24 @@ Usage:
   {{.Prog}} -v|--version
 
 Available Commands:
-  init       # Initialize {{.Prog}} for shell environment
-  install    # Install a package
-  add        # Alias of "install"
-  remove     # Uninstall a package
-  uninstall  # Alias of "remove"
-  list       # List installed packages
-  upgrade    # Upgrade installed packages
-  outdated   # Show outdated packages
-  link       # Pseudo installation of local directory
-  bundle     # Install packages at once with config file
-  prune      # Remove packages not defined in config file
-  destroy    # Delete all materials including packages
+  init         # Initialize {{.Prog}} for shell environment
+  install      # Install a package
+  add          # Alias of "install"
+  remove       # Uninstall a package
+  uninstall    # Alias of "remove"
+  list         # List installed packages
+  info         # Show details of an installed package
+  upgrade      # Upgrade installed packages
+  outdated     # Show outdated packages
+  rollback     # Roll back a package or the whole generation
+  generations  # List generations of installed packages
+  status       # Show packages which have local changes
+  link         # Pseudo installation of local directory
+  bundle       # Install packages at once with config file
+  prune        # Remove packages not defined in config file
+  sync         # Make installed packages match config file at once
+  compile      # Make a standalone script inlining included files
+  destroy      # Delete all materials including packages
 
 Run "{{.Prog}} COMMAND -h|--help" to see usage of each command.
 
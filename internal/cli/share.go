@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/progrhyme/shelp/internal/config"
+)
+
+// Directories under share directory where shells and man look up files. They follow layout of
+// "/usr/share" so that share directory can be added to XDG_DATA_DIRS
+const (
+	bashCompletionDir = "bash-completion/completions"
+	zshFunctionDir    = "zsh/site-functions"
+	fishCompletionDir = "fish/vendor_completions.d"
+	fishFunctionDir   = "fish/vendor_functions.d"
+	fishConfDir       = "fish/vendor_conf.d"
+	manDir            = "man"
+)
+
+// completionSearchDirs are directories in a package which conventionally contain completion files
+var completionSearchDirs = []string{
+	"completions",
+	"completion",
+	"contrib/completion",
+	"contrib/completions",
+	"etc/bash_completion.d",
+	"share/bash-completion/completions",
+	"share/zsh/site-functions",
+	"share/fish/vendor_completions.d",
+	// Fish plugin layout
+	"functions",
+	"conf.d",
+}
+
+// manSearchDirs are directories in a package which conventionally contain man pages
+var manSearchDirs = []string{"man", "doc/man", "docs/man", "share/man"}
+
+// completionTarget returns path under share directory to link a completion file. The kind of file
+// is told by its name and directory
+func completionTarget(file string) (string, bool) {
+	base := filepath.Base(file)
+	dir := filepath.Base(filepath.Dir(file))
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	for _, suffix := range []string{"-completion", "_completion", ".completion"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+
+	switch {
+	case strings.HasPrefix(base, "."), name == strings.ToUpper(name):
+		// Hidden file, or document like README
+		return "", false
+	case ext == ".fish" && dir == "functions":
+		return filepath.Join(fishFunctionDir, base), true
+	case ext == ".fish" && dir == "conf.d":
+		return filepath.Join(fishConfDir, base), true
+	case ext == ".fish":
+		return filepath.Join(fishCompletionDir, name+ext), true
+	case ext == ".zsh", ext == "" && strings.HasPrefix(base, "_"):
+		// zsh loads completion function from file of the same name
+		return filepath.Join(zshFunctionDir, "_"+strings.TrimPrefix(name, "_")), true
+	case dir == "functions", dir == "conf.d":
+		// Only fish files and zsh functions are expected
+		return "", false
+	case ext == "", ext == ".bash", ext == ".sh":
+		return filepath.Join(bashCompletionDir, name), true
+	}
+	return "", false
+}
+
+// manTarget returns path under share directory to link a man page. The section is told by its
+// extension like "foo.1" or "foo.1.gz"
+func manTarget(file string) (string, bool) {
+	base := filepath.Base(file)
+	ext := filepath.Ext(strings.TrimSuffix(base, ".gz"))
+	if len(ext) < 2 || ext[1] < '1' || ext[1] > '9' {
+		return "", false
+	}
+	return filepath.Join(manDir, "man"+ext[1:2], base), true
+}
+
+// linkPackageShare links completion files and man pages of a package into share directory. They
+// are listed in manifest of the package, or found in conventional directories. It returns linked
+// paths relative to share directory
+func linkPackageShare(
+	cmd verboseRunner, pkgPath string, manifest config.Manifest) ([]string, []string, error) {
+	completions := manifest.Completions
+	if len(completions) == 0 {
+		completions = findPackageFiles(pkgPath, completionSearchDirs, completionTarget)
+	}
+	man := manifest.Man
+	if len(man) == 0 {
+		man = findPackageFiles(pkgPath, manSearchDirs, manTarget)
+	}
+
+	var warn bool
+	link := func(files []string, target func(string) (string, bool)) ([]string, error) {
+		linked := []string{}
+		for _, file := range files {
+			src, ok := packageFile(pkgPath, file)
+			if !ok {
+				fmt.Fprintf(cmd.getErrs(), "Warning! File is out of package: %s\n", file)
+				warn = true
+				continue
+			}
+			dst, ok := target(file)
+			if !ok {
+				fmt.Fprintf(cmd.getErrs(), "Warning! Unknown type of file: %s\n", file)
+				warn = true
+				continue
+			}
+			switch err := createShareLink(cmd, src, dst); err {
+			case nil:
+				linked = append(linked, dst)
+			case ErrWarning:
+				warn = true
+			default:
+				return linked, err
+			}
+		}
+		return linked, nil
+	}
+
+	linkedCompletions, err := link(completions, completionTarget)
+	if err != nil {
+		return linkedCompletions, nil, err
+	}
+	linkedMan, err := link(man, manTarget)
+	if err != nil {
+		return linkedCompletions, linkedMan, err
+	}
+	if warn {
+		return linkedCompletions, linkedMan, ErrWarning
+	}
+	return linkedCompletions, linkedMan, nil
+}
+
+// findPackageFiles returns files under search directories in a package which have a target in
+// share directory. Paths are relative to the package
+func findPackageFiles(
+	pkgPath string, dirs []string, target func(string) (string, bool)) []string {
+	files := []string{}
+	for _, dir := range dirs {
+		root := filepath.Join(pkgPath, dir)
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			continue
+		}
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(pkgPath, path)
+			if err != nil {
+				return nil
+			}
+			if _, ok := target(rel); ok {
+				files = append(files, rel)
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+func createShareLink(cmd verboseRunner, src, dst string) error {
+	sym := filepath.Join(cmd.getConfig().SharePath(), dst)
+	if *cmd.getVerboseOpts().getVerbose() {
+		fmt.Fprintf(cmd.getOuts(), "Symlink: %s -> %s\n", sym, src)
+	}
+	if _, err := os.Stat(src); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Warning! File not found: %s\n", src)
+		return ErrWarning
+	}
+	if _, err := os.Lstat(sym); err == nil {
+		fmt.Fprintf(cmd.getErrs(), "Warning! Can't create link of %s which already exists\n", src)
+		return ErrWarning
+	}
+	if err := os.MkdirAll(filepath.Dir(sym), 0755); err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	if err := os.Symlink(src, sym); err != nil {
+		if os.IsExist(err) {
+			// Created by another package in parallel
+			fmt.Fprintf(cmd.getErrs(), "Warning! Can't create link of %s which already exists\n", src)
+			return ErrWarning
+		}
+		fmt.Fprintf(cmd.getErrs(), "Error! %s\n", err)
+		return ErrOperationFailed
+	}
+	return nil
+}
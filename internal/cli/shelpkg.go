@@ -1,10 +1,18 @@
 package cli
 
+import (
+	"fmt"
+
+	"github.com/progrhyme/shelp/internal/semver"
+)
+
 // shelp package params
 type shelpkg struct {
 	name            string
 	url             string
 	ref             string
+	commit          string
+	constraint      string
 	isBranchDefault bool
 	isCommitHash    bool
 }
@@ -13,6 +21,12 @@ func (pkg *shelpkg) isEquivalent(tgt shelpkg) bool {
 	if pkg.url != tgt.url {
 		return false
 	}
+	if pkg.commit != "" {
+		return pkg.commit == tgt.commit
+	}
+	if pkg.constraint != "" {
+		return pkg.satisfiedBy(tgt.ref)
+	}
 	if pkg.ref == tgt.ref {
 		return true
 	}
@@ -21,3 +35,39 @@ func (pkg *shelpkg) isEquivalent(tgt shelpkg) bool {
 	}
 	return false
 }
+
+// changesFrom describes differences of specs from installed package
+func (pkg *shelpkg) changesFrom(now shelpkg) []string {
+	changes := []string{}
+	if pkg.url != now.url {
+		changes = append(changes, fmt.Sprintf("from: %s => %s", now.url, pkg.url))
+	}
+	if pkg.constraint != "" {
+		if !pkg.satisfiedBy(now.ref) {
+			changes = append(changes, fmt.Sprintf("at: %s => %s", now.ref, pkg.constraint))
+		}
+	} else if pkg.ref != now.ref && (pkg.ref != "" || !now.isBranchDefault) {
+		newref := pkg.ref
+		if newref == "" {
+			newref = "(default)"
+		}
+		changes = append(changes, fmt.Sprintf("at: %s => %s", now.ref, newref))
+	}
+	if pkg.commit != "" && pkg.commit != now.commit {
+		changes = append(changes, fmt.Sprintf("commit: %s => %s", shortCommit(now.commit), shortCommit(pkg.commit)))
+	}
+	return changes
+}
+
+// satisfiedBy tells whether the tag meets version constraint of the package
+func (pkg *shelpkg) satisfiedBy(tag string) bool {
+	c, err := semver.ParseConstraint(pkg.constraint)
+	return err == nil && c.CheckTag(tag)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
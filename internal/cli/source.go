@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/progrhyme/shelp/internal/config"
+)
+
+// plainWord matches string which needs no quotation in shells
+var plainWord = regexp.MustCompile(`^[\w\-\.\/@+]+$`)
+
+// packageSource is a file of a package to be sourced at shell startup
+type packageSource struct {
+	pkg  string
+	file string
+	// Sourced after shell startup files are loaded
+	deferred bool
+}
+
+// configuredName returns name of a package configured in config file in the same way as
+// packageToInstall, but without validation
+func configuredName(from, as string) string {
+	if as != "" {
+		return as
+	}
+	if matched := remoteLocation.FindStringSubmatch(from); matched != nil {
+		return matched[3]
+	}
+	return strings.TrimSuffix(filepath.Base(from), ".git")
+}
+
+// packageSources returns files of installed packages to be sourced by the shell. Packages in
+// config file come first in the configured order, and others follow in order of name. Settings
+// in config file take precedence over manifest of packages recorded in their receipts
+func packageSources(cmd runner, shell string) []packageSource {
+	pkgs, err := ioutil.ReadDir(cmd.getConfig().PackagePath())
+	if err != nil {
+		return nil
+	}
+	installed := make(map[string]bool)
+	for _, pkg := range pkgs {
+		installed[pkg.Name()] = true
+	}
+
+	sources := []packageSource{}
+	add := func(name string, files, shells []string, deferred bool) {
+		rc, _ := loadReceipt(cmd.getConfig(), name)
+		if len(files) == 0 {
+			files = rc.Source
+		}
+		if len(shells) == 0 {
+			shells = rc.Shells
+		}
+		if len(shells) > 0 && !containsString(shells, shell) {
+			return
+		}
+		for _, file := range files {
+			sources = append(sources, packageSource{pkg: name, file: file, deferred: deferred})
+		}
+	}
+
+	for _, param := range cmd.getConfig().Packages {
+		name := configuredName(param.From, param.As)
+		if param.From == "" || !installed[name] {
+			continue
+		}
+		add(name, param.Source, param.Shells, param.Defer)
+		delete(installed, name)
+	}
+	for _, pkg := range pkgs {
+		if installed[pkg.Name()] {
+			add(pkg.Name(), nil, nil, false)
+		}
+	}
+	return sources
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// printSourceScripts prints statements to source files of packages by "include" function defined
+// in init scripts. Deferred files are sourced by hook which runs once before the first prompt, so
+// that they are loaded after shell startup files like "compinit" in ~/.zshrc
+func printSourceScripts(out io.Writer, cfg *config.Config, shell string, sources []packageSource) {
+	if len(sources) == 0 {
+		return
+	}
+	var now, later []string
+	for _, src := range sources {
+		line := sourceStatement(cfg, shell, src)
+		if src.deferred {
+			later = append(later, line)
+		} else {
+			now = append(now, line)
+		}
+	}
+
+	if shell != "tcsh" && shell != "csh" {
+		fmt.Fprintln(out, "\n# Scripts of packages")
+	}
+	for _, line := range now {
+		fmt.Fprintln(out, line)
+	}
+	if len(later) == 0 {
+		return
+	}
+
+	body := "  " + strings.Join(later, "\n  ")
+	switch shell {
+	case "zsh":
+		fmt.Fprintf(out, `_shelp_deferred() {
+  add-zsh-hook -d precmd _shelp_deferred
+  unfunction _shelp_deferred
+%s
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd _shelp_deferred
+`, body)
+	case "bash":
+		fmt.Fprintf(out, `_shelp_deferred() {
+  PROMPT_COMMAND="${PROMPT_COMMAND#_shelp_deferred;}"
+  unset -f _shelp_deferred
+%s
+}
+PROMPT_COMMAND="_shelp_deferred;${PROMPT_COMMAND}"
+`, body)
+	case "fish":
+		fmt.Fprintf(out, `function _shelp_deferred --on-event fish_prompt
+  functions -e _shelp_deferred
+%s
+end
+`, body)
+	default:
+		// No hook of prompt is available
+		for _, line := range later {
+			fmt.Fprintln(out, line)
+		}
+	}
+}
+
+// sourceStatement returns statement of the shell to source a file of a package
+func sourceStatement(cfg *config.Config, shell string, src packageSource) string {
+	include := fmt.Sprintf("include %s %s", shellQuote(shell, src.pkg), shellQuote(shell, src.file))
+	switch shell {
+	case "tcsh", "csh":
+		return include + ";"
+	case "pwsh", "powershell":
+		// Dot-sourced to load the file into global scope
+		return ". " + include
+	case "nu":
+		// Nushell parses sourced file before running scripts. So missing file can't be sourced
+		path := filepath.Join(cfg.RootPath(), "packages", src.pkg, src.file)
+		if _, err := os.Stat(path); err != nil {
+			return "# File not found: " + path
+		}
+		return "source " + shellQuote(shell, path)
+	default:
+		return include
+	}
+}
+
+// shellQuote quotes the string as a single word of the shell if needed
+func shellQuote(shell, s string) string {
+	if plainWord.MatchString(s) {
+		return s
+	}
+	switch shell {
+	case "fish", "xonsh":
+		s = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+		return "'" + s + "'"
+	case "pwsh", "powershell", "elvish":
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	case "nu":
+		// Single quoted string of Nushell has no escape
+		if strings.Contains(s, "'") {
+			return "r#'" + s + "'#"
+		}
+		return "'" + s + "'"
+	default:
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+}
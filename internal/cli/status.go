@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/template"
+
+	"github.com/progrhyme/shelp/internal/git"
+)
+
+type statusCmd struct {
+	gitCmd
+}
+
+// Strategies for packages with local changes on upgrade or re-install
+const (
+	keepLocal  = ""      // Skip the package
+	stashLocal = "stash" // Stash local modifications
+	forceLocal = "force" // Discard local modifications and commits
+)
+
+func newStatusCmd(common commonCmd, git git.Backend) statusCmd {
+	cmd := &statusCmd{}
+	cmd.commonCmd = common
+	cmd.git = git
+	setupCmdFlags(cmd, "status", cmd.usage)
+	setupOutputFlag(cmd)
+	return *cmd
+}
+
+func (cmd *statusCmd) usage() {
+	const help = `Summary:
+  Show installed packages which have local changes.
+
+Syntax:
+  {{.Prog}} {{.Cmd}} [-v|--verbose]
+
+Local changes are modified or untracked files, and commits which are not in remote repository.
+"upgrade" and "bundle" skip such packages unless any strategy for them is specified.
+With "-v|--verbose" option, it shows changed files as well.
+
+Options:
+`
+
+	t := template.Must(template.New("usage").Parse(help))
+	t.Execute(cmd.errs, struct{ Prog, Cmd string }{cmd.name, "status"})
+
+	cmd.flags.PrintDefaults()
+}
+
+func (cmd *statusCmd) parseAndExec(args []string) error {
+	done, err := parseStart(cmd, args, false, false)
+	if done || err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cmd, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var out io.Writer
+	if isJSONOutput(cmd) {
+		out = cmd.divertOuts()
+	}
+
+	records, err := cmd.checkAll()
+	if out != nil {
+		return printJSONResult(cmd, out, records, err)
+	}
+	return err
+}
+
+// checkAll checks local changes of all packages and returns the results
+func (cmd *statusCmd) checkAll() ([]packageRecord, error) {
+	records := []packageRecord{}
+	pkgs, err := installedPackages(cmd, true)
+	if err != nil {
+		return records, err
+	}
+
+	modified := 0
+	for _, pkg := range pkgs {
+		if interrupted(cmd) {
+			return records, ErrInterrupted
+		}
+		if isLinkedPackage(cmd, pkg.Name()) {
+			records = append(records, recordOf(cmd, pkg.Name(), statusLinked))
+			continue
+		}
+
+		path := filepath.Join(cmd.config.PackagePath(), pkg.Name())
+		st, err := cmd.git.Status(path, *cmd.option.verbose)
+		if err != nil {
+			failed := packageRecord{Name: pkg.Name(), Status: statusFailed, Error: err.Error()}
+			records = append(records, failed)
+			fmt.Fprintf(cmd.errs, "Error! Can't get status of \"%s\". Error = %v\n", pkg.Name(), err)
+			continue
+		}
+		if st.IsClean() {
+			records = append(records, recordOf(cmd, pkg.Name(), statusClean))
+			continue
+		}
+
+		modified++
+		records = append(records, recordOf(cmd, pkg.Name(), statusModified))
+		fmt.Fprintf(cmd.outs, "%s\t%s\n", pkg.Name(), describeStatus(st))
+		if *cmd.option.verbose {
+			for _, file := range st.Changes {
+				fmt.Fprintf(cmd.outs, "  %s\n", file)
+			}
+		}
+	}
+
+	if modified == 0 {
+		fmt.Fprintln(cmd.errs, "No package has local changes")
+	}
+	return records, nil
+}
+
+func describeStatus(st git.Status) string {
+	return fmt.Sprintf("%d changed files, %d unpushed commits", len(st.Changes), st.Unpushed)
+}
+
+// localStatus gets local changes of an installed package
+func localStatus(cmd gitRunner, name string) (git.Status, error) {
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	st, err := cmd.getGit().Status(path, *cmd.getVerboseOpts().getVerbose())
+	if err != nil {
+		fmt.Fprintf(cmd.getErrs(), "Error! Can't get status of \"%s\". Error = %v\n", name, err)
+		return st, ErrCommandFailed
+	}
+	if !st.IsClean() {
+		fmt.Fprintf(cmd.getErrs(), "\"%s\" has local changes: %s\n", name, describeStatus(st))
+	}
+	return st, nil
+}
+
+// handleLocalChanges deals with local changes of a package by given strategy before upgrading it.
+// It returns ErrLocalChanges when the package should be skipped
+func handleLocalChanges(cmd gitRunner, name, strategy string) error {
+	st, err := localStatus(cmd, name)
+	if err != nil || st.IsClean() {
+		return err
+	}
+
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	verbose := *cmd.getVerboseOpts().getVerbose()
+	switch {
+	case strategy == forceLocal:
+		if isDryRun(cmd) {
+			wouldDo(cmd, "discard local changes in %s", path)
+			return nil
+		}
+		fmt.Fprintf(cmd.getErrs(), "Discard local changes of \"%s\"\n", name)
+		if err = cmd.getGit().Discard(path, verbose); err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Error! Discarding local changes failed. Error = %v\n", err)
+			return ErrCommandFailed
+		}
+		return nil
+
+	case strategy == stashLocal && st.Unpushed == 0:
+		if isDryRun(cmd) {
+			wouldDo(cmd, "stash local changes in %s", path)
+			return nil
+		}
+		err = cmd.getGit().Stash(path, verbose)
+		if errors.Is(err, git.ErrNotSupported) {
+			// Upgrade runs in a new generation, and the previous one keeps the changes
+			if err = cmd.getGit().Discard(path, verbose); err == nil {
+				fmt.Fprintf(
+					cmd.getErrs(), "Local changes of \"%s\" are left in the previous generation. "+
+						"Use \"rollback --generation\" to restore them\n", name)
+				return nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(cmd.getErrs(), "Error! Stashing local changes failed. Error = %v\n", err)
+			return ErrCommandFailed
+		}
+		fmt.Fprintf(
+			cmd.getErrs(), "Stashed local changes of \"%s\". Run \"git stash pop\" in %s to restore\n",
+			name, path)
+		return nil
+
+	case strategy == stashLocal:
+		fmt.Fprintf(
+			cmd.getErrs(), "Skip \"%s\". Unpushed commits can't be stashed. Use \"--force\" to drop them\n",
+			name)
+		return ErrLocalChanges
+
+	default:
+		fmt.Fprintf(cmd.getErrs(), "Skip \"%s\" to keep local changes\n", name)
+		return ErrLocalChanges
+	}
+}
@@ -0,0 +1,339 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mattn/go-isatty"
+	"github.com/progrhyme/shelp/internal/config"
+	"github.com/progrhyme/shelp/internal/git"
+)
+
+type syncCmd struct {
+	gitCmd
+	yes   *bool
+	link  *bool
+	force *bool
+}
+
+// Kinds of actions in sync plan
+const (
+	actionInstall   = "install"
+	actionReinstall = "re-install"
+	actionUpgrade   = "upgrade"
+	actionRemove    = "remove"
+)
+
+var actionMarks = map[string]string{
+	actionInstall:   "+",
+	actionReinstall: "~",
+	actionUpgrade:   "^",
+	actionRemove:    "-",
+}
+
+// syncAction is an operation for a package in sync plan
+type syncAction struct {
+	kind    string
+	name    string
+	changes []string
+	args    installArgs
+}
+
+func newSyncCmd(common commonCmd, git git.Backend) syncCmd {
+	cmd := &syncCmd{}
+	cmd.commonCmd = common
+	cmd.git = git
+	setupCmdFlags(cmd, "sync", cmd.usage)
+	cmd.yes = cmd.flags.BoolP("yes", "y", false, "# Apply plan without confirmation")
+	cmd.link = cmd.flags.Bool("link", false, "# Remove symlinks not configured as well")
+	cmd.force = cmd.flags.Bool("force", false, "# Discard local changes of packages to apply plan")
+	return *cmd
+}
+
+func (cmd *syncCmd) usage() {
+	const help = `Summary:
+  Make installed packages match config file at once.
+
+Syntax:
+  {{.Prog}} {{.Cmd}} [-c|--config CONFIG] [-y|--yes] [--link] [--force] [--dry-run]
+
+This command computes a plan comparing installed packages with config file, and applies it after
+confirmation. A plan consists of the following actions:
+
+  + install     # Package is configured but not installed
+  ~ re-install  # "from" or "at" of package is changed
+  ^ upgrade     # Package has update
+  - remove      # Package is not configured
+
+The plan is applied to a new generation, which is switched to when it succeeds.
+
+With "--dry-run" option, it shows the plan and operations to apply it without changing anything.
+
+Packages to re-install or upgrade which have local changes are skipped by default.
+With "--force" option, their local changes are discarded.
+
+This doesn't remove symlinks created with "link" command by default.
+To remove them, specify "--link" option.
+
+Options:
+`
+
+	t := template.Must(template.New("usage").Parse(help))
+	t.Execute(cmd.errs, struct{ Prog, Cmd string }{cmd.name, "sync"})
+	cmd.flags.PrintDefaults()
+}
+
+func (cmd *syncCmd) parseAndExec(args []string) error {
+	done, err := parseStart(cmd, args, false, false)
+	if done || err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(cmd.config.Packages) == 0 {
+		fmt.Fprintln(cmd.errs, "No package is configured")
+		cmd.flags.Usage()
+		return ErrCanceled
+	}
+
+	if !isDryRun(cmd) {
+		if err = prepareInstallDirectories(cmd.config); err != nil {
+			fmt.Fprintf(cmd.errs, "Error! %s\n", err)
+			return ErrOperationFailed
+		}
+	}
+
+	plan, err := cmd.makePlan()
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		fmt.Fprintln(cmd.outs, "All packages are in sync with config")
+		return nil
+	}
+
+	cmd.printPlan(plan)
+
+	if isatty.IsTerminal(os.Stdin.Fd()) && !*cmd.yes && !isDryRun(cmd) {
+		if ok, err := confirm(cmd, os.Stdin); err != nil {
+			return err
+		} else if !ok {
+			return ErrCanceled
+		}
+	}
+
+	return inGeneration(cmd, "sync", func() error { return cmd.apply(plan) })
+}
+
+// makePlan compares installed packages with configured ones and returns actions to apply
+func (cmd *syncCmd) makePlan() ([]syncAction, error) {
+	plan := []syncAction{}
+
+	installed := make(map[string]bool)
+	if files, err := ioutil.ReadDir(cmd.config.PackagePath()); err == nil {
+		for _, fi := range files {
+			installed[fi.Name()] = true
+		}
+	}
+
+	configured := make(map[string]bool)
+	for _, param := range cmd.config.Packages {
+		if param.From == "" {
+			fmt.Fprintf(cmd.errs, "Warning! \"from\" is not specified. Skips. pkg = %+v\n", param)
+			continue
+		}
+
+		args := installArgs{
+			from:      param.From,
+			as:        param.As,
+			at:        param.At,
+			bin:       param.Bin,
+			depends:   param.Depends,
+			overwrite: true,
+			strategy:  cmd.strategy(),
+			mode:      modeBundle,
+		}
+		pkg, err := packageToInstall(cmd, args)
+		if err != nil {
+			return plan, err
+		}
+		configured[pkg.name] = true
+		action := syncAction{name: pkg.name, args: args}
+
+		switch {
+		case !installed[pkg.name]:
+			action.kind = actionInstall
+			action.changes = []string{fmt.Sprintf("from: %s", pkg.url)}
+			if pkg.constraint != "" {
+				action.changes = append(action.changes, fmt.Sprintf("at: %s", pkg.constraint))
+			} else if pkg.ref != "" {
+				action.changes = append(action.changes, fmt.Sprintf("at: %s", pkg.ref))
+			}
+
+		case isLinkedPackage(cmd, pkg.name):
+			action.kind = actionReinstall
+			action.changes = []string{"replace package created by \"link\""}
+
+		default:
+			now, err := packageInstalled(cmd, filepath.Join(cmd.config.PackagePath(), pkg.name))
+			if err != nil {
+				return plan, err
+			}
+			if !pkg.isEquivalent(now) {
+				action.kind = actionReinstall
+				action.changes = pkg.changesFrom(now)
+				break
+			}
+
+			// Checked for update later all together
+			action.kind = actionUpgrade
+		}
+		plan = append(plan, action)
+	}
+
+	upgrades := []int{}
+	names := []string{}
+	for i, action := range plan {
+		if action.kind == actionUpgrade {
+			upgrades = append(upgrades, i)
+			names = append(names, action.name)
+		}
+	}
+	outdated := make(map[int]bool)
+	for j, result := range checkUpdates(cmd, names, false) {
+		if result.err == ErrInterrupted {
+			return plan, ErrInterrupted
+		}
+		if result.err != nil {
+			return plan, ErrCommandFailed
+		}
+		outdated[upgrades[j]] = result.outdated
+	}
+	actions := []syncAction{}
+	for i, action := range plan {
+		if action.kind != actionUpgrade || outdated[i] {
+			actions = append(actions, action)
+		}
+	}
+	plan = actions
+
+	names = []string{}
+	for name := range installed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if configured[name] || (!*cmd.link && isLinkedPackage(cmd, name)) {
+			continue
+		}
+		if dependents := dependentsOf(cmd, name); len(dependents) > 0 {
+			if *cmd.option.verbose {
+				fmt.Fprintf(
+					cmd.errs, "\"%s\" is required by %s. Skip\n", name, strings.Join(dependents, ", "))
+			}
+			continue
+		}
+		plan = append(plan, syncAction{kind: actionRemove, name: name})
+	}
+
+	return plan, nil
+}
+
+func (cmd *syncCmd) printPlan(plan []syncAction) {
+	counts := make(map[string]int)
+	fmt.Fprintln(cmd.outs, "Plan:")
+	for _, action := range plan {
+		counts[action.kind]++
+		fmt.Fprintf(cmd.outs, "%s %s (%s)\n", actionMarks[action.kind], action.name, action.kind)
+		for _, change := range action.changes {
+			fmt.Fprintf(cmd.outs, "    %s\n", change)
+		}
+	}
+	fmt.Fprintf(
+		cmd.outs, "\n%d to install, %d to re-install, %d to upgrade, %d to remove\n",
+		counts[actionInstall], counts[actionReinstall], counts[actionUpgrade], counts[actionRemove])
+}
+
+// strategy returns how to deal with local changes of packages
+func (cmd *syncCmd) strategy() string {
+	if *cmd.force {
+		return forceLocal
+	}
+	return keepLocal
+}
+
+// apply runs actions in plan. Removals go first to release names of executables
+func (cmd *syncCmd) apply(plan []syncAction) error {
+	var (
+		success int
+		failure int
+	)
+	count := func(err error) {
+		switch err {
+		case nil, ErrAlreadyInstalled:
+			success++
+		default:
+			failure++
+		}
+	}
+
+	for _, action := range plan {
+		if action.kind == actionRemove {
+			count(removePackage(cmd, action.name, false))
+		}
+	}
+	strategy := cmd.strategy()
+	for _, action := range plan {
+		switch action.kind {
+		case actionInstall, actionReinstall:
+			count(installPackage(cmd, action.args))
+		case actionUpgrade:
+			fmt.Fprintf(cmd.outs, "Upgrading \"%s\" ...\n", action.name)
+			count(upgradePackage(cmd, action.name, strategy))
+		}
+	}
+
+	if interrupted(cmd) {
+		return ErrInterrupted
+	}
+	if !isDryRun(cmd) {
+		cmd.updateLock()
+	}
+
+	if failure > 0 {
+		if success > 0 {
+			fmt.Fprintln(cmd.errs, "There are some errors")
+			return ErrWarning
+		}
+		fmt.Fprintln(cmd.errs, "Sync failed")
+		return ErrOperationFailed
+	}
+	return nil
+}
+
+// updateLock records state of configured packages into lock file
+func (cmd *syncCmd) updateLock() {
+	lock := config.Lock{}
+	for _, param := range cmd.config.Packages {
+		pkg, err := packageToInstall(cmd, installArgs{from: param.From, as: param.As, at: param.At})
+		if err != nil || param.From == "" {
+			continue
+		}
+		if locked, ok := lockPackage(cmd, param.From, param.At, pkg.name); ok {
+			lock.Packages = append(lock.Packages, locked)
+		}
+	}
+	if err := lock.Save(cmd.config.LockFile()); err != nil {
+		fmt.Fprintf(cmd.errs, "Error! Writing lock file failed. Error = %v\n", err)
+	}
+}
@@ -1,7 +1,9 @@
 package cli
 
 import (
+	"context"
 	"io"
+	"time"
 
 	"github.com/progrhyme/shelp/internal/config"
 	"github.com/progrhyme/shelp/internal/git"
@@ -12,6 +14,8 @@ type runner interface {
 	getConfig() *config.Config
 	getOuts() io.Writer
 	getErrs() io.Writer
+	getContext() context.Context
+	getName() string
 	getFlags() *pflag.FlagSet
 	setFlags(*pflag.FlagSet)
 }
@@ -23,6 +27,8 @@ type commonCmd struct {
 	outs   io.Writer
 	errs   io.Writer
 	name   string
+	// Canceled on interruption by signal
+	ctx context.Context
 }
 
 func (cmd *commonCmd) getConfig() *config.Config {
@@ -37,6 +43,17 @@ func (cmd *commonCmd) getErrs() io.Writer {
 	return cmd.errs
 }
 
+func (cmd *commonCmd) getName() string {
+	return cmd.name
+}
+
+func (cmd *commonCmd) getContext() context.Context {
+	if cmd.ctx == nil {
+		return context.Background()
+	}
+	return cmd.ctx
+}
+
 func (cmd *commonCmd) getFlags() *pflag.FlagSet {
 	return &cmd.flags
 }
@@ -45,16 +62,27 @@ func (cmd *commonCmd) setFlags(flags *pflag.FlagSet) {
 	cmd.flags = *flags
 }
 
+// divertOuts makes outputs for human go to stderr, and returns the original writer of stdout to
+// write machine-readable output
+func (cmd *commonCmd) divertOuts() io.Writer {
+	out := cmd.outs
+	cmd.outs = cmd.errs
+	return out
+}
+
 type flavor interface {
 	getHelp() *bool
 	getConfig() *string
+	getOutput() *string
 	setHelp(*bool)
 	setConfig(*string)
+	setOutput(*string)
 }
 
 type commonOpts struct {
 	help   *bool
 	config *string
+	output *string
 }
 
 func (flag *commonOpts) getHelp() *bool {
@@ -65,6 +93,10 @@ func (flag *commonOpts) getConfig() *string {
 	return flag.config
 }
 
+func (flag *commonOpts) getOutput() *string {
+	return flag.output
+}
+
 func (flag *commonOpts) setHelp(help *bool) {
 	flag.help = help
 }
@@ -73,6 +105,10 @@ func (flag *commonOpts) setConfig(conf *string) {
 	flag.config = conf
 }
 
+func (flag *commonOpts) setOutput(output *string) {
+	flag.output = output
+}
+
 type helpRunner interface {
 	runner
 	getOpts() flavor
@@ -90,22 +126,44 @@ func (cmd *helpCmd) getOpts() flavor {
 type verboseFlavor interface {
 	flavor
 	getVerbose() *bool
+	getDryRun() *bool
+	getWait() *time.Duration
 	setVerbose(*bool)
+	setDryRun(*bool)
+	setWait(*time.Duration)
 }
 
 type verboseOpts struct {
 	commonOpts
 	verbose *bool
+	dryRun  *bool
+	wait    *time.Duration
 }
 
 func (flag *verboseOpts) getVerbose() *bool {
 	return flag.verbose
 }
 
+func (flag *verboseOpts) getDryRun() *bool {
+	return flag.dryRun
+}
+
+func (flag *verboseOpts) getWait() *time.Duration {
+	return flag.wait
+}
+
 func (flag *verboseOpts) setVerbose(verbose *bool) {
 	flag.verbose = verbose
 }
 
+func (flag *verboseOpts) setDryRun(dryRun *bool) {
+	flag.dryRun = dryRun
+}
+
+func (flag *verboseOpts) setWait(wait *time.Duration) {
+	flag.wait = wait
+}
+
 type verboseRunner interface {
 	runner
 	getVerboseOpts() verboseFlavor
@@ -127,14 +185,27 @@ func (cmd *verboseCmd) getVerboseOpts() verboseFlavor {
 
 type gitRunner interface {
 	verboseRunner
-	getGit() *git.Git
+	getGit() git.Backend
+	setGit(git.Backend)
 }
 
 type gitCmd struct {
 	verboseCmd
-	git git.Git
+	git git.Backend
+}
+
+func (cmd *gitCmd) getGit() git.Backend {
+	return cmd.git
+}
+
+func (cmd *gitCmd) setGit(backend git.Backend) {
+	cmd.git = backend
 }
 
-func (cmd *gitCmd) getGit() *git.Git {
-	return &cmd.git
+// divertOuts makes outputs for human including ones of git go to stderr, and returns the original
+// writer of stdout to write machine-readable output
+func (cmd *gitCmd) divertOuts() io.Writer {
+	out := cmd.commonCmd.divertOuts()
+	cmd.git = cmd.git.WithOutput(cmd.errs, cmd.errs)
+	return out
 }
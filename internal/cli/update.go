@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultCheckTTL is how long results of update check are reused when "outdated.ttl" is not set
+const defaultCheckTTL = 10 * time.Minute
+
+// checkJobs is the number of packages checked for update in parallel
+const checkJobs = 8
+
+// updateCacheFile caches results of update check under cache directory
+const updateCacheFile = "updates.json"
+
+// updateCheck is a cached result of update check of a package. It is valid while the package is
+// at the same commit and ref
+type updateCheck struct {
+	Commit    string    `json:"commit"`
+	Ref       string    `json:"ref"`
+	Outdated  bool      `json:"outdated"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type updateResult struct {
+	outdated bool
+	err      error
+}
+
+// checkUpdates checks updates of packages in parallel and returns results in order of names.
+// Results cached within TTL are used if useCache is true. New results are cached unless in dry-run
+func checkUpdates(cmd gitRunner, names []string, useCache bool) []updateResult {
+	results := make([]updateResult, len(names))
+	cache := loadUpdateCache(cmd)
+	ttl := cmd.getConfig().Outdated.TTL
+	if ttl == 0 {
+		ttl = defaultCheckTTL
+	}
+
+	receipts := make([]receipt, len(names))
+	todo := []int{}
+	for i, name := range names {
+		rc, ok := loadReceipt(cmd.getConfig(), name)
+		if !ok {
+			todo = append(todo, i)
+			continue
+		}
+		receipts[i] = rc
+		if c, hit := cache[name]; useCache && ttl > 0 && hit && c.Commit == rc.Commit &&
+			c.Ref == rc.Ref && time.Since(c.CheckedAt) < ttl {
+			results[i] = updateResult{outdated: c.Outdated}
+			continue
+		}
+		todo = append(todo, i)
+	}
+	if len(todo) == 0 {
+		return results
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	jobs := checkJobs
+	if len(todo) < jobs {
+		jobs = len(todo)
+	}
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				outdated, err := hasPackageUpdate(cmd, names[i])
+				results[i] = updateResult{outdated: outdated, err: err}
+			}
+		}()
+	}
+	for _, i := range todo {
+		if interrupted(cmd) {
+			results[i] = updateResult{err: ErrInterrupted}
+			continue
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	now := time.Now()
+	for _, i := range todo {
+		rc := receipts[i]
+		if results[i].err != nil || rc.Commit == "" || isLinkedPackage(cmd, names[i]) {
+			continue
+		}
+		cache[names[i]] = updateCheck{
+			Commit: rc.Commit, Ref: rc.Ref, Outdated: results[i].outdated, CheckedAt: now,
+		}
+	}
+	if !isDryRun(cmd) {
+		saveUpdateCache(cmd, cache)
+	}
+	return results
+}
+
+func loadUpdateCache(cmd runner) map[string]updateCheck {
+	cache := make(map[string]updateCheck)
+	data, err := ioutil.ReadFile(filepath.Join(cmd.getConfig().CachePath(), updateCacheFile))
+	if err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+// saveUpdateCache writes the cache by rename not to be read partially by another process. Failure
+// is ignored as the cache is not essential
+func saveUpdateCache(cmd runner, cache map[string]updateCheck) {
+	dir := cmd.getConfig().CachePath()
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil || os.MkdirAll(dir, 0755) != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, updateCacheFile+".*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, updateCacheFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
@@ -11,13 +11,17 @@ import (
 
 type upgradeCmd struct {
 	gitCmd
+	stash *bool
+	force *bool
 }
 
-func newUpgradeCmd(common commonCmd, git git.Git) upgradeCmd {
+func newUpgradeCmd(common commonCmd, git git.Backend) upgradeCmd {
 	cmd := &upgradeCmd{}
 	cmd.commonCmd = common
 	cmd.git = git
 	setupCmdFlags(cmd, "upgrade", cmd.usage)
+	cmd.stash = cmd.flags.Bool("stash", false, "# Stash local changes before upgrade")
+	cmd.force = cmd.flags.Bool("force", false, "# Discard local changes before upgrade")
 	return *cmd
 }
 
@@ -32,6 +36,17 @@ Syntax:
   # Upgrade a single package
   {{.Prog}} {{.Cmd}} <package>
 
+Packages with local changes, i.e. modified or untracked files or commits not pushed to remote, are
+skipped by default. With "--stash" option, local modifications are stashed before upgrade, or left
+in the previous generation with go-git backend. With "--force" option, local modifications and
+commits are discarded.
+Use "status" command to see which packages have local changes.
+
+Packages are upgraded in a new generation, which is switched to when the upgrade succeeds.
+
+With "--dry-run" option, this command still queries upstream by "git ls-remote" to check updates,
+but doesn't change working trees of packages.
+
 Options:
 `
 
@@ -47,11 +62,18 @@ func (cmd *upgradeCmd) parseAndExec(args []string) error {
 		return err
 	}
 
-	if cmd.flags.NArg() == 0 {
-		return cmd.upgradeAll()
+	unlock, err := lockRoot(cmd, true)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	return cmd.upgradeOne(cmd.flags.Arg(0))
+	return inGeneration(cmd, "upgrade", func() error {
+		if cmd.flags.NArg() == 0 {
+			return cmd.upgradeAll()
+		}
+		return cmd.upgradeOne(cmd.flags.Arg(0))
+	})
 }
 
 func (cmd *upgradeCmd) upgradeOne(pkg string) error {
@@ -61,13 +83,12 @@ func (cmd *upgradeCmd) upgradeOne(pkg string) error {
 		return ErrArgument
 	}
 
-	pwd, err := chdir(cmd, path)
-	if err != nil {
-		return ErrOperationFailed
+	if _, pinned := isPinned(cmd, pkg); pinned {
+		fmt.Fprintf(cmd.outs, "Release \"%s\" from rollback\n", pkg)
+		return upgradePackage(cmd, pkg, cmd.strategy())
 	}
-	defer os.Chdir(pwd)
 
-	hasUpdate, err := cmd.git.HasUpdate(*cmd.option.verbose)
+	hasUpdate, err := checkUpdate(cmd, pkg)
 	if err != nil {
 		return ErrCommandFailed
 	}
@@ -77,11 +98,94 @@ func (cmd *upgradeCmd) upgradeOne(pkg string) error {
 		return nil
 	}
 
-	err = cmd.git.Pull(*cmd.option.verbose)
+	return upgradePackage(cmd, pkg, cmd.strategy())
+}
+
+// strategy returns how to deal with local changes of packages
+func (cmd *upgradeCmd) strategy() string {
+	switch {
+	case *cmd.force:
+		return forceLocal
+	case *cmd.stash:
+		return stashLocal
+	default:
+		return keepLocal
+	}
+}
+
+// upgradePackage updates working tree of a package to the latest of its upstream, or the newest tag
+// within its version constraint. Local changes in the package are dealt with by given strategy
+func upgradePackage(cmd gitRunner, name, strategy string) error {
+	if !isDryRun(cmd) {
+		if err := detachPackage(cmd, name); err != nil {
+			return err
+		}
+	}
+	if err := handleLocalChanges(cmd, name, strategy); err != nil {
+		return err
+	}
+
+	path := filepath.Join(cmd.getConfig().PackagePath(), name)
+	rc, ok := loadReceipt(cmd.getConfig(), name)
+	if ok && rc.Constraint != "" {
+		return upgradeToTag(cmd, rc)
+	}
+
+	verbose := *cmd.getVerboseOpts().getVerbose()
+	if ok && rc.Pin != nil {
+		// Rolled back package is on detached HEAD
+		if rc.Pin.Ref == "" {
+			fmt.Fprintf(cmd.getErrs(), "Error! \"%s\" tracked no branch before rollback\n", name)
+			return ErrOperationFailed
+		}
+		if isDryRun(cmd) {
+			wouldDo(cmd, "check out %s in %s", rc.Pin.Ref, path)
+		} else if err := cmd.getGit().Checkout(path, rc.Pin.Ref, verbose); err != nil {
+			return ErrCommandFailed
+		} else if repo, err := cmd.getGit().Worktree(path, verbose); err != nil {
+			return ErrOperationFailed
+		} else if repo.Branch == "" {
+			// Package at a tag has nothing to pull
+			return refreshReceipt(cmd, name)
+		}
+	}
+
+	if isDryRun(cmd) {
+		wouldDo(cmd, "update %s to the latest of upstream", path)
+		return nil
+	}
+	if interrupted(cmd) {
+		return ErrInterrupted
+	}
+	err := cmd.getGit().Pull(path, verbose)
+	if err != nil && interrupted(cmd) {
+		return ErrInterrupted
+	}
 	if err != nil {
 		return ErrCommandFailed
 	}
-	return nil
+	return refreshReceipt(cmd, name)
+}
+
+func upgradeToTag(cmd gitRunner, rc receipt) error {
+	path := filepath.Join(cmd.getConfig().PackagePath(), rc.Name)
+	tag, err := resolveConstraint(cmd, rc.URL, rc.Constraint)
+	if err != nil {
+		return err
+	}
+	if tag == "" || tag == rc.Ref {
+		return nil
+	}
+
+	if isDryRun(cmd) {
+		wouldDo(cmd, "switch %s from tag %s to %s", path, rc.Ref, tag)
+		return nil
+	}
+	fmt.Fprintf(cmd.getOuts(), "Switch \"%s\" from tag %s to %s\n", rc.Name, rc.Ref, tag)
+	if err = cmd.getGit().CheckoutTag(path, tag, *cmd.getVerboseOpts().getVerbose()); err != nil {
+		return ErrCommandFailed
+	}
+	return refreshReceipt(cmd, rc.Name)
 }
 
 func (cmd *upgradeCmd) upgradeAll() error {
@@ -90,34 +194,57 @@ func (cmd *upgradeCmd) upgradeAll() error {
 		return err
 	}
 
-	upgraded := 0
+	names := []string{}
 	for _, pkg := range pkgs {
-		old, err := hasPackageUpdate(cmd, pkg.Name())
-		switch err {
+		if rc, pinned := isPinned(cmd, pkg.Name()); pinned {
+			fmt.Fprintf(
+				cmd.errs, "Skip \"%s\" rolled back to %s. Run \"%s upgrade %s\" to upgrade it\n",
+				pkg.Name(), shortCommit(rc.Commit), cmd.name, pkg.Name())
+			continue
+		}
+		names = append(names, pkg.Name())
+	}
+
+	upgraded, skipped := 0, 0
+	for i, result := range checkUpdates(cmd, names, false) {
+		if interrupted(cmd) {
+			return ErrInterrupted
+		}
+		switch result.err {
 		case nil:
 			// do nothing
 		case ErrOperationFailed:
-			return err
+			return result.err
 		default:
 			return ErrCommandFailed
 		}
 
-		if !old {
+		if !result.outdated {
 			continue
 		}
 
-		fmt.Fprintf(cmd.outs, "Upgrading \"%s\" ...\n", pkg.Name())
-		err = cmd.upgradeOne(pkg.Name())
+		fmt.Fprintf(cmd.outs, "Upgrading \"%s\" ...\n", names[i])
+		err = upgradePackage(cmd, names[i], cmd.strategy())
+		if err == ErrLocalChanges {
+			skipped++
+			continue
+		}
 		if err != nil {
 			return err
 		}
 		upgraded++
 	}
 
-	if upgraded > 0 {
+	if upgraded > 0 && isDryRun(cmd) {
+		fmt.Fprintf(cmd.outs, "%d packages would be upgraded\n", upgraded)
+	} else if upgraded > 0 {
 		fmt.Fprintf(cmd.outs, "%d packages upgraded\n", upgraded)
-	} else {
+	} else if skipped == 0 {
 		fmt.Fprintln(cmd.outs, "All packages are up-to-date")
 	}
+	if skipped > 0 {
+		fmt.Fprintf(cmd.errs, "%d packages are skipped due to local changes\n", skipped)
+		return ErrWarning
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,12 +17,32 @@ type properties struct {
 	}
 	Git struct {
 		Shallow bool
+		Jobs    int
+		Backend string
+		// Time limit of each git operation accessing remote repository
+		Timeout time.Duration
+		// Number of retries of git operations failed by transient error
+		Retries int
+	}
+	Generations struct {
+		Keep int
+	}
+	Outdated struct {
+		// How long results of update check are reused
+		TTL time.Duration
 	}
 	Packages []struct {
-		From string
-		Bin  []string
-		As   string
-		At   string
+		From    string
+		Bin     []string
+		As      string
+		At      string
+		Depends []string
+		// Files to be sourced at shell startup. Override "source" in manifest of the package
+		Source []string
+		// Shells to source the files. Override "shells" in manifest of the package
+		Shells []string
+		// Source the files after shell startup files are loaded
+		Defer bool
 	}
 }
 
@@ -30,6 +51,8 @@ type Config struct {
 	outs io.Writer
 	errs io.Writer
 	file string
+	// Directory of generation being built
+	generation string
 	properties
 }
 
@@ -102,17 +125,93 @@ func (c *Config) RootPath() string {
 }
 
 func (c *Config) PackagePath() string {
-	return filepath.Join(c.RootPath(), "packages")
+	return filepath.Join(c.contentPath(), "packages")
 }
 
 func (c *Config) BinPath() string {
+	return filepath.Join(c.contentPath(), "bin")
+}
+
+// ReceiptPath returns directory of records of installed packages
+func (c *Config) ReceiptPath() string {
+	return filepath.Join(c.contentPath(), "receipts")
+}
+
+// SharePath returns directory of links to completions and man pages of packages
+func (c *Config) SharePath() string {
+	return filepath.Join(c.contentPath(), "share")
+}
+
+// ShellBinPath returns directory of executables to add to PATH. It always leads to executables of
+// the current generation
+func (c *Config) ShellBinPath() string {
 	return filepath.Join(c.RootPath(), "bin")
 }
 
+// ShellSharePath returns directory of completions and man pages to be looked up by shells. It always
+// leads to ones of the current generation
+func (c *Config) ShellSharePath() string {
+	return filepath.Join(c.RootPath(), "share")
+}
+
+// InitScriptFile returns path of init scripts compiled for the shell
+func (c *Config) InitScriptFile(shell string) string {
+	return filepath.Join(c.RootPath(), "init."+shell)
+}
+
+// RootLockFile returns path of file locked by running shelp processes
+func (c *Config) RootLockFile() string {
+	return filepath.Join(c.RootPath(), ".lock")
+}
+
+// GenerationPath returns directory which contains generations of packages and executables
+func (c *Config) GenerationPath() string {
+	return filepath.Join(c.RootPath(), "generations")
+}
+
+// CurrentLink returns path of symlink to the current generation
+func (c *Config) CurrentLink() string {
+	return filepath.Join(c.RootPath(), "current")
+}
+
+// SetGeneration makes paths of packages, executables and receipts point into directory of a
+// generation being built. Empty string resets them to the current generation
+func (c *Config) SetGeneration(dir string) {
+	c.generation = dir
+}
+
+// contentPath returns directory which contains packages, executables and receipts. It is the root
+// directory unless generations are introduced
+func (c *Config) contentPath() string {
+	if c.generation != "" {
+		return c.generation
+	}
+	if target, err := os.Readlink(c.CurrentLink()); err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(c.RootPath(), target)
+		}
+		return target
+	}
+	return c.RootPath()
+}
+
+// CachePath returns directory of cached data which can be removed at any time
+func (c *Config) CachePath() string {
+	return filepath.Join(c.RootPath(), "cache")
+}
+
 func (c *Config) TempPath() string {
 	return filepath.Join(c.RootPath(), "tmp")
 }
 
+// LockFile returns path of lock file which is put next to loaded config file
+func (c *Config) LockFile() string {
+	if c.file == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(c.file), LockFileName)
+}
+
 // Same as RootPath(), but don't set c.Path.Root
 func (c *Config) rootPath() string {
 	if c.Path.Root == "" {
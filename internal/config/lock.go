@@ -0,0 +1,57 @@
+package config
+
+import (
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+const LockFileName = "shelp.lock"
+
+// Lock represents contents of lock file which pins packages to exact commits
+type Lock struct {
+	Packages []LockedPackage
+}
+
+// LockedPackage is a resolved state of a package configured in config file, or its dependency
+type LockedPackage struct {
+	Name   string
+	From   string
+	At     string `yaml:",omitempty"`
+	URL    string
+	Ref    string `yaml:",omitempty"`
+	Commit string
+	// Installed as dependency of configured packages
+	Dependency bool `yaml:",omitempty"`
+}
+
+// LoadLock reads lock file of given path
+func LoadLock(path string) (Lock, error) {
+	lock := Lock{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lock, err
+	}
+	err = yaml.Unmarshal(data, &lock)
+	return lock, err
+}
+
+// Save writes lock into given path
+func (l *Lock) Save(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	header := []byte("# This file is generated by shelp. Do not edit manually.\n")
+	return ioutil.WriteFile(path, append(header, data...), 0644)
+}
+
+// Find returns locked package of given name
+func (l *Lock) Find(name string) (LockedPackage, bool) {
+	for _, pkg := range l.Packages {
+		if pkg.Name == name {
+			return pkg, true
+		}
+	}
+	return LockedPackage{}, false
+}
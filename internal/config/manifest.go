@@ -0,0 +1,44 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+const ManifestFileName = "shelp.yml"
+
+// Manifest represents contents of manifest file placed at the root of a package by its author
+type Manifest struct {
+	// Executable files to link into bin directory
+	Bin []string
+	// Shell completion files
+	Completions []string
+	// Man page files
+	Man []string
+	// Files to be sourced at shell startup
+	Source []string
+	// Commands which the package requires
+	Requires []string
+	// Shells which the package supports
+	Shells []string
+	// Packages which the package depends on
+	Depends []string
+}
+
+// LoadManifest reads manifest file in given package directory. It returns false when the package
+// has no manifest
+func LoadManifest(dir string) (Manifest, bool, error) {
+	manifest := Manifest{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return manifest, false, nil
+	}
+	if err != nil {
+		return manifest, false, err
+	}
+	err = yaml.Unmarshal(data, &manifest)
+	return manifest, err == nil, err
+}
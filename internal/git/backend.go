@@ -0,0 +1,57 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotSupported is returned by operations which the backend doesn't implement
+var ErrNotSupported = errors.New("Not supported by the backend")
+
+// Backend is an interface of git operations for shelp packages
+type Backend interface {
+	// Clone clones src repository into dst directory
+	Clone(src, dst string, opts Option) error
+	// Checkout switches the working tree in dir to ref
+	Checkout(dir, ref string, verbose bool) error
+	// RemoteCommit returns hash of the commit which branch points to in remote repository of url
+	RemoteCommit(url, branch string, verbose bool) (string, error)
+	// Pull updates the working tree in dir
+	Pull(dir string, verbose bool) error
+	// CheckoutTag fetches tag from remote of the working tree in dir and switches to it
+	CheckoutTag(dir, tag string, verbose bool) error
+	// RemoteTags returns names of tags in remote repository of url
+	RemoteTags(url string, verbose bool) ([]string, error)
+	// Status returns local changes in the working tree in dir
+	Status(dir string, verbose bool) (Status, error)
+	// Stash saves local modifications in the working tree in dir into stash
+	Stash(dir string, verbose bool) error
+	// Discard drops local modifications and commits in the working tree in dir
+	Discard(dir string, verbose bool) error
+	// Worktree returns state of the working tree in dir
+	Worktree(dir string, verbose bool) (Worktree, error)
+	// WithOutput returns a copy of the backend which writes outputs into given writers
+	WithOutput(out, err io.Writer) Backend
+	// WithContext returns a copy of the backend whose operations are aborted when ctx is done
+	WithContext(ctx context.Context) Backend
+}
+
+// Names of backends to be specified by config
+const (
+	ExecBackend  = "exec"
+	GoGitBackend = "go-git"
+)
+
+// NewBackend returns a backend of given name
+func NewBackend(name string, out, err io.Writer) (Backend, error) {
+	switch name {
+	case "", ExecBackend:
+		return NewGit(out, err), nil
+	case GoGitBackend:
+		return NewGoGit(out, err), nil
+	default:
+		return nil, fmt.Errorf("Unknown git backend: %s", name)
+	}
+}
@@ -1,6 +1,7 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,11 +11,12 @@ import (
 	"strings"
 )
 
-// Git command executor
+// Git is a backend which executes git command
 type Git struct {
 	cmd string
 	out io.Writer
 	err io.Writer
+	ctx context.Context
 }
 
 // Option for some operations to pass from outside of this package
@@ -25,14 +27,26 @@ type Option struct {
 	Verbose bool
 }
 
-func NewGit(out, err io.Writer) Git {
+// NewGit returns a backend which runs git command of $GIT_COMMAND or "git"
+func NewGit(out, err io.Writer) *Git {
 	cmd := os.Getenv("GIT_COMMAND")
 	if cmd == "" {
 		cmd = "git"
 	}
-	return Git{cmd: cmd, out: out, err: err}
+	return &Git{cmd: cmd, out: out, err: err, ctx: context.Background()}
 }
 
+// WithOutput returns a copy of Git which writes outputs into given writers
+func (g *Git) WithOutput(out, err io.Writer) Backend {
+	return &Git{cmd: g.cmd, out: out, err: err, ctx: g.ctx}
+}
+
+// WithContext returns a copy of the backend. Running git command is killed when ctx is done
+func (g *Git) WithContext(ctx context.Context) Backend {
+	return &Git{cmd: g.cmd, out: g.out, err: g.err, ctx: ctx}
+}
+
+// Clone clones src repository into dst directory
 func (g *Git) Clone(src, dst string, opts Option) error {
 	args := []string{"clone", src}
 	if opts.Commit == "" {
@@ -43,88 +57,168 @@ func (g *Git) Clone(src, dst string, opts Option) error {
 			args = append(args, "--depth=1")
 		}
 		args = append(args, dst)
-		return g.prepareCommand(args, opts.Verbose).Run()
+		return g.run(g.prepareCommand(args, opts.Verbose))
 	}
 
 	args = append(args, dst)
-	err := g.prepareCommand(args, opts.Verbose).Run()
+	err := g.run(g.prepareCommand(args, opts.Verbose))
 	if err != nil {
 		return err
 	}
-	pwd, err := os.Getwd()
+
+	return g.Checkout(dst, opts.Commit, opts.Verbose)
+}
+
+// Checkout switches the working tree in dir to ref
+func (g *Git) Checkout(dir, ref string, verbose bool) error {
+	return g.run(g.prepareCommand([]string{"-C", dir, "checkout", ref}, verbose))
+}
+
+// RemoteCommit returns hash of the commit which branch points to in remote repository of url
+func (g *Git) RemoteCommit(url, branch string, verbose bool) (string, error) {
+	ref := "refs/heads/" + branch
+	s, err := g.getCommandOutput([]string{"ls-remote", "--heads", url, ref}, verbose, false)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(s.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("Branch not found in remote: %s", branch)
+}
+
+// Pull updates the working tree in dir
+func (g *Git) Pull(dir string, verbose bool) error {
+	if g.isShallow(dir, verbose) {
+		return g.pullShallow(dir, verbose)
+	}
+
+	cmd := exec.CommandContext(g.ctx, g.cmd, []string{"-C", dir, "pull"}...)
+	cmd.Stdout = g.out
+	cmd.Stderr = g.err
+	if verbose {
+		fmt.Fprintf(g.err, "[CMD] %s\n", cmd.String())
+	}
+
+	return g.run(cmd)
+}
+
+// pullShallow fetches only the tip of upstream branch and resets the working tree to it, so that
+// the repository stays shallow. Force-pushed branch is also followed without merge
+func (g *Git) pullShallow(dir string, verbose bool) error {
+	args := []string{"-C", dir, "symbolic-ref", "--short", "HEAD"}
+	s, err := g.getCommandOutput(args, verbose, false)
 	if err != nil {
-		fmt.Fprintln(g.err, "Error! Can't get current directory")
 		return err
 	}
-	if err := os.Chdir(dst); err != nil {
-		fmt.Fprintf(g.err, "Error! Directory change failed. Path = %s\n", dst)
+	branch := strings.TrimSpace(s.String())
+	refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)
+	args = []string{"-C", dir, "fetch", "--depth=1", "--no-tags", "origin", refspec}
+	if err = g.run(g.prepareCommand(args, verbose)); err != nil {
+		fmt.Fprintf(g.err, "Error! git fetch failed. Branch = %s, Error = %v\n", branch, err)
 		return err
 	}
-	defer os.Chdir(pwd)
+	args = []string{"-C", dir, "reset", "--hard", "--quiet", "origin/" + branch}
+	if err = g.run(g.prepareCommand(args, verbose)); err != nil {
+		fmt.Fprintf(g.err, "Error! git reset failed. Branch = %s, Error = %v\n", branch, err)
+		return err
+	}
+	return nil
+}
 
-	return g.prepareCommand([]string{"checkout", opts.Commit}, opts.Verbose).Run()
+// isShallow tells whether the repository in dir is a shallow clone
+func (g *Git) isShallow(dir string, verbose bool) bool {
+	args := []string{"-C", dir, "rev-parse", "--is-shallow-repository"}
+	s, err := g.getCommandOutput(args, verbose, true)
+	return err == nil && strings.TrimSpace(s.String()) == "true"
+}
 
+// CheckoutTag fetches tag from remote of the working tree in dir and switches to it
+func (g *Git) CheckoutTag(dir, tag string, verbose bool) error {
+	args := []string{"-C", dir, "fetch", "--no-tags", "origin", "tag", tag}
+	if g.isShallow(dir, verbose) {
+		args = append(args, "--depth=1")
+	}
+	if err := g.run(g.prepareCommand(args, verbose)); err != nil {
+		fmt.Fprintf(g.err, "Error! git fetch failed. Tag = %s, Error = %v\n", tag, err)
+		return err
+	}
+	return g.Checkout(dir, tag, verbose)
 }
 
-// HasUpdate is supposed to be executed inside a working tree
-func (g *Git) HasUpdate(verbose bool) (bool, error) {
-	err := g.prepareCommand([]string{"fetch"}, verbose).Run()
+// RemoteTags returns names of tags in remote repository of url
+func (g *Git) RemoteTags(url string, verbose bool) ([]string, error) {
+	tags := []string{}
+	s, err := g.getCommandOutput([]string{"ls-remote", "--tags", "--refs", url}, verbose, false)
 	if err != nil {
-		fmt.Fprintf(g.err, "Error! git fetch failed. Error = %v", err)
-		return false, err
+		return tags, err
 	}
-	args := []string{"symbolic-ref", "--short", "--quiet", "HEAD"}
-	if err = g.prepareCommand(args, false).Run(); err != nil {
-		// Probably detached HEAD, no need to update
-		return false, nil
+	for _, line := range strings.Split(s.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/tags/") {
+			tags = append(tags, strings.TrimPrefix(fields[1], "refs/tags/"))
+		}
 	}
+	return tags, nil
+}
 
-	args = []string{"rev-list", "--count", "HEAD...HEAD@{upstream}"}
-	s, err := g.getCommandOutput(args, verbose, false)
+// Status returns local changes in the working tree in dir
+func (g *Git) Status(dir string, verbose bool) (Status, error) {
+	st := Status{}
+	s, err := g.getCommandOutput([]string{"-C", dir, "status", "--porcelain"}, verbose, false)
 	if err != nil {
-		return false, err
+		return st, err
+	}
+	for _, line := range strings.Split(s.String(), "\n") {
+		if len(line) > 3 {
+			st.Changes = append(st.Changes, line[3:])
+		}
 	}
 
-	var i int
-	_, err = fmt.Fscanln(strings.NewReader(s.String()), &i)
+	args := []string{"-C", dir, "rev-list", "--count", "HEAD", "--not", "--remotes", "--tags"}
+	s, err = g.getCommandOutput(args, verbose, false)
 	if err != nil {
-		fmt.Fprintf(g.err, "Error! Cast failed: %v -> int. Error = %v", s, err)
-		return false, err
+		return st, err
 	}
+	_, err = fmt.Fscanln(strings.NewReader(s.String()), &st.Unpushed)
+	return st, err
+}
 
-	if i > 0 {
-		return true, nil
-	} else {
-		return false, nil
-	}
+// Stash saves local modifications in the working tree in dir into stash
+func (g *Git) Stash(dir string, verbose bool) error {
+	args := []string{"-C", dir, "stash", "push", "--include-untracked", "--message", "shelp"}
+	return g.run(g.prepareCommand(args, verbose))
 }
 
-// Pull is supposed to be executed inside a working tree
-func (g *Git) Pull(verbose bool) error {
-	// NOTE: "shallow" option for Pull operation is incomplete.
-	//  It happens to cause merge conflicts.
-	//if g.shallow {
-	//	cmd := g.prepareCommand([]string{"fetch", "--depth=1"}, verbose)
-	//	if err := cmd.Run(); err != nil {
-	//		return err
-	//	}
-	//}
-	cmd := exec.Command(g.cmd, []string{"pull"}...)
-	cmd.Stdout = g.out
-	cmd.Stderr = g.err
-	if verbose {
-		fmt.Fprintf(g.err, "[CMD] %s\n", cmd.String())
+// Discard drops local modifications and commits in the working tree in dir
+func (g *Git) Discard(dir string, verbose bool) error {
+	for _, args := range [][]string{
+		{"-C", dir, "reset", "--hard", "--quiet"},
+		{"-C", dir, "clean", "-d", "--force", "--quiet"},
+	} {
+		if err := g.run(g.prepareCommand(args, verbose)); err != nil {
+			return err
+		}
 	}
 
-	return cmd.Run()
+	args := []string{"-C", dir, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}"}
+	if _, err := g.getCommandOutput(args, verbose, true); err != nil {
+		// No upstream branch; e.g. tag or commit is checked out
+		return nil
+	}
+	args = []string{"-C", dir, "reset", "--hard", "--quiet", "@{upstream}"}
+	return g.run(g.prepareCommand(args, verbose))
 }
 
-// Worktree is supposed to be executed inside a working tree
-func (g *Git) Worktree(verbose bool) (Worktree, error) {
+// Worktree returns state of the working tree in dir
+func (g *Git) Worktree(dir string, verbose bool) (Worktree, error) {
 	wt := Worktree{}
 
 	getCmdOut := func(args []string) string {
-		s, err := g.getCommandOutput(args, verbose, true)
+		s, err := g.getCommandOutput(append([]string{"-C", dir}, args...), verbose, true)
 		if err == nil {
 			return strings.TrimRight(s.String(), "\r\n")
 		}
@@ -132,15 +226,20 @@ func (g *Git) Worktree(verbose bool) (Worktree, error) {
 	}
 	wt.RemoteURL = getCmdOut([]string{"config", "--get", "remote.origin.url"})
 	wt.Branch = getCmdOut([]string{"symbolic-ref", "--short", "--quiet", "HEAD"})
+	if wt.Branch != "" {
+		merge := getCmdOut([]string{"config", "--get", "branch." + wt.Branch + ".merge"})
+		wt.Upstream = strings.TrimPrefix(merge, "refs/heads/")
+	}
 	wt.Tag = getCmdOut([]string{"tag", "--points-at", "HEAD"})
+	wt.Commit = getCmdOut([]string{"rev-parse", "HEAD"})
 	defbranch := getCmdOut([]string{"symbolic-ref", "--short", "--quiet", "refs/remotes/origin/HEAD"})
-	wt.defaultBranch = filepath.Base(defbranch)
+	wt.DefaultBranch = filepath.Base(defbranch)
 
 	return wt, nil
 }
 
 func (g *Git) prepareCommand(args []string, verbose bool) *exec.Cmd {
-	cmd := exec.Command(g.cmd, args...)
+	cmd := exec.CommandContext(g.ctx, g.cmd, args...)
 	if verbose {
 		cmd.Stdout = g.out
 		cmd.Stderr = g.err
@@ -154,7 +253,7 @@ func (g *Git) prepareCommand(args []string, verbose bool) *exec.Cmd {
 
 func (g *Git) getCommandOutput(args []string, verbose, suppressError bool) (*strings.Builder, error) {
 	s := &strings.Builder{}
-	cmd := exec.Command(g.cmd, args...)
+	cmd := exec.CommandContext(g.ctx, g.cmd, args...)
 	cmd.Stdout = s
 	if suppressError {
 		cmd.Stderr = ioutil.Discard
@@ -164,7 +263,7 @@ func (g *Git) getCommandOutput(args []string, verbose, suppressError bool) (*str
 	if verbose {
 		fmt.Fprintf(g.err, "[CMD] %s\n", cmd.String())
 	}
-	if err := cmd.Run(); err != nil {
+	if err := g.run(cmd); err != nil {
 		if !suppressError {
 			fmt.Fprintf(g.err, "Error! git command failed. Args = %v, Error = %v", args, err)
 		}
@@ -172,3 +271,13 @@ func (g *Git) getCommandOutput(args []string, verbose, suppressError bool) (*str
 	}
 	return s, nil
 }
+
+// run runs the command and returns CommandError with its error output on failure
+func (g *Git) run(cmd *exec.Cmd) error {
+	stderr := &strings.Builder{}
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	if err := cmd.Run(); err != nil {
+		return &CommandError{Args: cmd.Args[1:], Stderr: stderr.String(), Err: err}
+	}
+	return nil
+}
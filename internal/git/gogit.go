@@ -0,0 +1,489 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// GoGit is a backend implemented in pure Go which does not require git command
+type GoGit struct {
+	out io.Writer
+	err io.Writer
+	ctx context.Context
+}
+
+const remoteName = "origin"
+
+func NewGoGit(out, err io.Writer) *GoGit {
+	return &GoGit{out: out, err: err, ctx: context.Background()}
+}
+
+func (g *GoGit) WithOutput(out, err io.Writer) Backend {
+	return &GoGit{out: out, err: err, ctx: g.ctx}
+}
+
+// WithContext returns a copy of the backend. Transfers from remote are aborted when ctx is done
+func (g *GoGit) WithContext(ctx context.Context) Backend {
+	return &GoGit{out: g.out, err: g.err, ctx: ctx}
+}
+
+func (g *GoGit) Clone(src, dst string, opts Option) error {
+	g.trace(opts.Verbose, "clone %s %s", src, dst)
+	cloneOpts := gogit.CloneOptions{URL: src, RemoteName: remoteName}
+	if opts.Verbose {
+		cloneOpts.Progress = g.err
+	}
+	if opts.Commit == "" && opts.Shallow {
+		cloneOpts.Depth = 1
+	}
+
+	var err error
+	if opts.Commit == "" && opts.Branch != "" {
+		// Like "git clone --branch", the ref can be either a branch or a tag
+		cloneOpts.ReferenceName = plumbing.NewBranchReferenceName(opts.Branch)
+		_, err = gogit.PlainCloneContext(g.ctx, dst, false, &cloneOpts)
+		if err != nil {
+			os.RemoveAll(dst)
+			cloneOpts.ReferenceName = plumbing.NewTagReferenceName(opts.Branch)
+			_, err = gogit.PlainCloneContext(g.ctx, dst, false, &cloneOpts)
+		}
+	} else {
+		_, err = gogit.PlainCloneContext(g.ctx, dst, false, &cloneOpts)
+	}
+	if err != nil {
+		fmt.Fprintf(g.err, "Error! Clone failed. Error = %v\n", err)
+		return err
+	}
+
+	if err = g.setRemoteHead(dst); err != nil && opts.Verbose {
+		fmt.Fprintf(g.err, "Warning! Can't resolve default branch. Error = %v\n", err)
+	}
+
+	if opts.Commit != "" {
+		return g.Checkout(dst, opts.Commit, opts.Verbose)
+	}
+	return nil
+}
+
+// setRemoteHead creates "refs/remotes/origin/HEAD" as git command does on cloning
+func (g *GoGit) setRemoteHead(dir string) error {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return err
+	}
+	refs, err := listRefs(g.ctx, remote)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			head := plumbing.NewRemoteHEADReferenceName(remoteName)
+			target := plumbing.NewRemoteReferenceName(remoteName, ref.Target().Short())
+			return repo.Storer.SetReference(plumbing.NewSymbolicReference(head, target))
+		}
+	}
+	return nil
+}
+
+func (g *GoGit) Checkout(dir, ref string, verbose bool) error {
+	g.trace(verbose, "checkout %s in %s", ref, dir)
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		fmt.Fprintf(g.err, "Error! Can't resolve revision: %s. Error = %v\n", ref, err)
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return wt.Checkout(&gogit.CheckoutOptions{Hash: *hash})
+}
+
+func (g *GoGit) RemoteCommit(url, branch string, verbose bool) (string, error) {
+	g.trace(verbose, "ls-remote %s %s", url, branch)
+	refs, err := g.listRemote(url)
+	if err != nil {
+		fmt.Fprintf(g.err, "Error! Can't list remote refs. URL = %s, Error = %v\n", url, err)
+		return "", err
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return ref.Hash().String(), nil
+		}
+	}
+	return "", fmt.Errorf("Branch not found in remote: %s", branch)
+}
+
+func (g *GoGit) Pull(dir string, verbose bool) error {
+	g.trace(verbose, "pull in %s", dir)
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	if isShallowRepo(repo) {
+		return g.pullShallow(repo, verbose)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	opts := gogit.PullOptions{RemoteName: remoteName}
+	if verbose {
+		opts.Progress = g.err
+	}
+	err = wt.PullContext(g.ctx, &opts)
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		fmt.Fprintf(g.err, "Error! git pull failed. Error = %v\n", err)
+		return err
+	}
+	return nil
+}
+
+func (g *GoGit) CheckoutTag(dir, tag string, verbose bool) error {
+	g.trace(verbose, "fetch tag %s in %s", tag, dir)
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	ref := plumbing.NewTagReferenceName(tag)
+	refspec := gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))
+	if isShallowRepo(repo) {
+		err = g.fetchShallow(repo, refspec, verbose)
+	} else {
+		err = repo.FetchContext(g.ctx, &gogit.FetchOptions{
+			RemoteName: remoteName,
+			RefSpecs:   []gitconfig.RefSpec{refspec},
+			Tags:       gogit.NoTags,
+		})
+	}
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		fmt.Fprintf(g.err, "Error! git fetch failed. Tag = %s, Error = %v\n", tag, err)
+		return err
+	}
+	return g.Checkout(dir, tag, verbose)
+}
+
+func (g *GoGit) RemoteTags(url string, verbose bool) ([]string, error) {
+	g.trace(verbose, "ls-remote %s", url)
+	tags := []string{}
+	refs, err := g.listRemote(url)
+	if err != nil {
+		fmt.Fprintf(g.err, "Error! Can't list remote refs. URL = %s, Error = %v\n", url, err)
+		return tags, err
+	}
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref.Name().Short())
+		}
+	}
+	return tags, nil
+}
+
+// listRemote lists refs in remote repository of url
+func (g *GoGit) listRemote(url string) ([]*plumbing.Reference, error) {
+	remote := gogit.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: remoteName,
+		URLs: []string{url},
+	})
+	return listRefs(g.ctx, remote)
+}
+
+// listRefs lists refs of the remote. Listing of go-git takes no context, so it is left behind
+// when ctx is done
+func listRefs(ctx context.Context, remote *gogit.Remote) ([]*plumbing.Reference, error) {
+	type listed struct {
+		refs []*plumbing.Reference
+		err  error
+	}
+	done := make(chan listed, 1)
+	go func() {
+		refs, err := remote.List(&gogit.ListOptions{})
+		done <- listed{refs, err}
+	}()
+	select {
+	case l := <-done:
+		return l.refs, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pullShallow fetches only the tip of upstream branch and resets the working tree to it, so that
+// the repository stays shallow. Force-pushed branch is also followed without merge
+func (g *GoGit) pullShallow(repo *gogit.Repository, verbose bool) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if !head.Name().IsBranch() {
+		return fmt.Errorf("HEAD is not on a branch")
+	}
+	branch := head.Name().Short()
+	upstream := plumbing.NewRemoteReferenceName(remoteName, branch)
+	refspec := gitconfig.RefSpec(fmt.Sprintf("+%s:%s", head.Name(), upstream))
+	if err = g.fetchShallow(repo, refspec, verbose); err != nil {
+		fmt.Fprintf(g.err, "Error! git fetch failed. Branch = %s, Error = %v\n", branch, err)
+		return err
+	}
+
+	ref, err := repo.Reference(upstream, true)
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return wt.Reset(&gogit.ResetOptions{Commit: ref.Hash(), Mode: gogit.HardReset})
+}
+
+// fetchShallow fetches refs of spec with depth 1 into memory, then copies the objects and refs
+// into the repository. go-git fails to fetch onto shallow repository in usual way
+func (g *GoGit) fetchShallow(repo *gogit.Repository, spec gitconfig.RefSpec, verbose bool) error {
+	origin, err := repo.Remote(remoteName)
+	if err != nil {
+		return err
+	}
+	mem := memory.NewStorage()
+	remote := gogit.NewRemote(mem, &gitconfig.RemoteConfig{
+		Name: remoteName,
+		URLs: origin.Config().URLs,
+	})
+	opts := gogit.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   []gitconfig.RefSpec{spec},
+		Depth:      1,
+		Tags:       gogit.NoTags,
+		Force:      true,
+	}
+	if verbose {
+		opts.Progress = g.err
+	}
+	if err = remote.FetchContext(g.ctx, &opts); err != nil {
+		return err
+	}
+
+	objects, err := mem.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return err
+	}
+	err = objects.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := repo.Storer.SetEncodedObject(obj)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	refs, err := mem.IterReferences()
+	if err != nil {
+		return err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		return repo.Storer.SetReference(ref)
+	})
+	if err != nil {
+		return err
+	}
+
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	fetched, err := mem.Shallow()
+	if err != nil {
+		return err
+	}
+	known := make(map[plumbing.Hash]bool)
+	for _, hash := range shallows {
+		known[hash] = true
+	}
+	for _, hash := range fetched {
+		if !known[hash] {
+			shallows = append(shallows, hash)
+			known[hash] = true
+		}
+	}
+	return repo.Storer.SetShallow(shallows)
+}
+
+func isShallowRepo(repo *gogit.Repository) bool {
+	shallows, err := repo.Storer.Shallow()
+	return err == nil && len(shallows) > 0
+}
+
+func (g *GoGit) Status(dir string, verbose bool) (Status, error) {
+	g.trace(verbose, "status in %s", dir)
+	st := Status{}
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return st, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return st, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return st, err
+	}
+	for path, file := range status {
+		if file.Worktree != gogit.Unmodified || file.Staging != gogit.Unmodified {
+			st.Changes = append(st.Changes, path)
+		}
+	}
+	sort.Strings(st.Changes)
+
+	st.Unpushed, err = g.countUnpushed(repo)
+	return st, err
+}
+
+// countUnpushed counts commits from HEAD which are not reachable from remote branches nor tags
+func (g *GoGit) countUnpushed(repo *gogit.Repository) (int, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return 0, err
+	}
+	tips := []*object.Commit{}
+	known := make(map[plumbing.Hash]bool)
+	refs, err := repo.References()
+	if err != nil {
+		return 0, err
+	}
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !(ref.Name().IsRemote() || ref.Name().IsTag()) {
+			return nil
+		}
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			// Annotated tag
+			hash = tag.Target
+		}
+		if commit, err := repo.CommitObject(hash); err == nil {
+			tips = append(tips, commit)
+			known[hash] = true
+		}
+		return nil
+	})
+
+	count := 0
+	commit, err := repo.CommitObject(head.Hash())
+	for err == nil && !known[commit.Hash] {
+		for _, tip := range tips {
+			if ok, _ := commit.IsAncestor(tip); ok {
+				return count, nil
+			}
+		}
+		count++
+		if commit.NumParents() == 0 {
+			break
+		}
+		commit, err = commit.Parent(0)
+	}
+	return count, nil
+}
+
+// Stash is not supported as go-git has no stash. It returns ErrNotSupported
+func (g *GoGit) Stash(dir string, verbose bool) error {
+	return ErrNotSupported
+}
+
+func (g *GoGit) Discard(dir string, verbose bool) error {
+	g.trace(verbose, "discard local changes in %s", dir)
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+
+	hash := head.Hash()
+	if head.Name().IsBranch() {
+		upstream := plumbing.NewRemoteReferenceName(remoteName, head.Name().Short())
+		if ref, err := repo.Reference(upstream, true); err == nil {
+			hash = ref.Hash()
+		}
+	}
+	if err = wt.Reset(&gogit.ResetOptions{Commit: hash, Mode: gogit.HardReset}); err != nil {
+		return err
+	}
+	return wt.Clean(&gogit.CleanOptions{Dir: true})
+}
+
+func (g *GoGit) Worktree(dir string, verbose bool) (Worktree, error) {
+	wt := Worktree{}
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return wt, err
+	}
+
+	if remote, err := repo.Remote(remoteName); err == nil && len(remote.Config().URLs) > 0 {
+		wt.RemoteURL = remote.Config().URLs[0]
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return wt, err
+	}
+	wt.Commit = head.Hash().String()
+	if head.Name().IsBranch() {
+		wt.Branch = head.Name().Short()
+		if cfg, err := repo.Config(); err == nil && cfg.Branches[wt.Branch] != nil {
+			wt.Upstream = cfg.Branches[wt.Branch].Merge.Short()
+		}
+	}
+
+	if tags, err := repo.Tags(); err == nil {
+		tags.ForEach(func(ref *plumbing.Reference) error {
+			hash := ref.Hash()
+			if tag, err := repo.TagObject(hash); err == nil {
+				// Annotated tag
+				hash = tag.Target
+			}
+			if hash == head.Hash() && wt.Tag == "" {
+				wt.Tag = ref.Name().Short()
+			}
+			return nil
+		})
+	}
+
+	defbranch, err := repo.Reference(plumbing.NewRemoteHEADReferenceName(remoteName), false)
+	if err == nil && defbranch.Type() == plumbing.SymbolicReference {
+		wt.DefaultBranch = strings.TrimPrefix(defbranch.Target().Short(), remoteName+"/")
+	}
+
+	return wt, nil
+}
+
+func (g *GoGit) trace(verbose bool, format string, args ...interface{}) {
+	if verbose {
+		fmt.Fprintf(g.err, "[go-git] "+format+"\n", args...)
+	}
+}
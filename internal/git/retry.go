@@ -0,0 +1,229 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// defaultBackoff is the interval before the first retry. It is doubled on each retry
+const defaultBackoff = time.Second
+
+// CommandError is an error of git command which holds its error output
+type CommandError struct {
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Policy of timeout and retry for operations accessing remote repository
+type Policy struct {
+	// Time limit of each attempt. Zero means no limit
+	Timeout time.Duration
+	// Number of retries after the first attempt fails by retryable error
+	Retries int
+	// Interval before the first retry
+	Backoff time.Duration
+}
+
+// Messages of git which tell the failure won't be resolved by retry. They are checked before
+// transientFailure as some of them are reported with "unable to access"
+var permanentFailure = regexp.MustCompile(strings.Join([]string{
+	`repository not found`,
+	`repository '[^']*' not found`,
+	`repository '[^']*' does not exist`,
+	`does not appear to be a git repository`,
+	`remote branch \S+ not found`,
+	`authentication failed`,
+	`could not read username`,
+	`invalid username or password`,
+	`permission denied`,
+	`returned error: 4\d\d`,
+	`couldn't find remote ref`,
+	`did not match any`,
+}, "|"))
+
+// Messages of git which tell the failure is probably transient
+var transientFailure = regexp.MustCompile(strings.Join([]string{
+	`could not resolve host`,
+	`temporary failure in name resolution`,
+	`connection timed out`,
+	`operation timed out`,
+	`connection reset`,
+	`connection refused`,
+	`failed to connect`,
+	`early eof`,
+	`the remote end hung up unexpectedly`,
+	`rpc failed`,
+	`returned error: 5\d\d`,
+	`gnutls_handshake`,
+}, "|"))
+
+// IsRetryable tells whether the failed operation may succeed by retry
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, transport.ErrRepositoryNotFound),
+		errors.Is(err, transport.ErrEmptyRemoteRepository),
+		errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod),
+		errors.Is(err, plumbing.ErrReferenceNotFound),
+		errors.Is(err, plumbing.ErrObjectNotFound):
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	msg := err.Error()
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		msg = cmdErr.Stderr
+	}
+	msg = strings.ToLower(msg)
+	return !permanentFailure.MatchString(msg) && transientFailure.MatchString(msg)
+}
+
+// retrier is a backend which applies Policy to operations accessing remote repository of the
+// wrapped backend. Other operations are passed through
+type retrier struct {
+	Backend
+	policy Policy
+	ctx    context.Context
+	err    io.Writer
+}
+
+// WithPolicy wraps the backend to apply timeout and retry of the policy. Warnings on retry are
+// written into err
+func WithPolicy(b Backend, policy Policy, err io.Writer) Backend {
+	if policy.Timeout <= 0 && policy.Retries <= 0 {
+		return b
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = defaultBackoff
+	}
+	return &retrier{Backend: b, policy: policy, ctx: context.Background(), err: err}
+}
+
+func (r *retrier) WithOutput(out, err io.Writer) Backend {
+	return &retrier{Backend: r.Backend.WithOutput(out, err), policy: r.policy, ctx: r.ctx, err: err}
+}
+
+func (r *retrier) WithContext(ctx context.Context) Backend {
+	return &retrier{Backend: r.Backend.WithContext(ctx), policy: r.policy, ctx: ctx, err: r.err}
+}
+
+// Partial clone is removed before retry as git refuses to clone into non-empty directory
+func (r *retrier) Clone(src, dst string, opts Option) error {
+	_, err := r.do("clone "+src, func(b Backend) (interface{}, error) {
+		if err := b.Clone(src, dst, opts); err != nil {
+			os.RemoveAll(dst)
+			return nil, err
+		}
+		return nil, nil
+	})
+	return err
+}
+
+func (r *retrier) RemoteCommit(url, branch string, verbose bool) (string, error) {
+	commit, err := r.do("ls-remote "+url, func(b Backend) (interface{}, error) {
+		return b.RemoteCommit(url, branch, verbose)
+	})
+	if err != nil {
+		return "", err
+	}
+	return commit.(string), nil
+}
+
+func (r *retrier) Pull(dir string, verbose bool) error {
+	_, err := r.do("pull in "+dir, func(b Backend) (interface{}, error) {
+		return nil, b.Pull(dir, verbose)
+	})
+	return err
+}
+
+func (r *retrier) CheckoutTag(dir, tag string, verbose bool) error {
+	_, err := r.do("fetch tag "+tag+" in "+dir, func(b Backend) (interface{}, error) {
+		return nil, b.CheckoutTag(dir, tag, verbose)
+	})
+	return err
+}
+
+func (r *retrier) RemoteTags(url string, verbose bool) ([]string, error) {
+	tags, err := r.do("ls-remote "+url, func(b Backend) (interface{}, error) {
+		return b.RemoteTags(url, verbose)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags.([]string), nil
+}
+
+// do runs the operation with timeout, and retries it with exponential backoff while it fails by
+// retryable error. It returns the result of the operation
+func (r *retrier) do(what string, op func(Backend) (interface{}, error)) (interface{}, error) {
+	backoff := r.policy.Backoff
+	for attempt := 0; ; attempt++ {
+		result, err := r.attempt(op)
+		if err == nil || r.ctx.Err() != nil {
+			return result, err
+		}
+		if attempt >= r.policy.Retries || !IsRetryable(err) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				fmt.Fprintf(r.err, "Error! git %s timed out after %s\n", what, r.policy.Timeout)
+			}
+			return nil, err
+		}
+
+		fmt.Fprintf(
+			r.err, "Warning! git %s failed. Retry in %s (%d/%d). Error = %v\n",
+			what, backoff, attempt+1, r.policy.Retries, err)
+		select {
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// attempt runs the operation once. Backends abort the operation when the context is done, and it
+// is waited for to finish, so that it doesn't touch the repository while the next attempt runs
+func (r *retrier) attempt(op func(Backend) (interface{}, error)) (interface{}, error) {
+	ctx, cancel := r.ctx, context.CancelFunc(func() {})
+	if r.policy.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.ctx, r.policy.Timeout)
+	}
+	defer cancel()
+
+	result, err := op(r.Backend.WithContext(ctx))
+	if err != nil && ctx.Err() == context.DeadlineExceeded && r.ctx.Err() == nil {
+		return nil, fmt.Errorf("Timed out after %s: %w", r.policy.Timeout, context.DeadlineExceeded)
+	}
+	if err != nil && r.ctx.Err() != nil {
+		return nil, r.ctx.Err()
+	}
+	return result, err
+}
@@ -0,0 +1,123 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hungBackend is a backend whose remote operations block until context is done
+type hungBackend struct {
+	Backend
+	ctx   context.Context
+	count *opCount
+}
+
+// opCount counts operations running at once
+type opCount struct {
+	mutex   sync.Mutex
+	running int
+	most    int
+}
+
+func (b *hungBackend) RemoteCommit(url, branch string, verbose bool) (string, error) {
+	return "", b.hang()
+}
+
+func (b *hungBackend) Clone(src, dst string, opts Option) error {
+	return b.hang()
+}
+
+func (b *hungBackend) hang() error {
+	b.count.mutex.Lock()
+	b.count.running++
+	if b.count.running > b.count.most {
+		b.count.most = b.count.running
+	}
+	b.count.mutex.Unlock()
+
+	<-b.ctx.Done()
+	// Aborting takes a while
+	time.Sleep(20 * time.Millisecond)
+
+	b.count.mutex.Lock()
+	b.count.running--
+	b.count.mutex.Unlock()
+	return b.ctx.Err()
+}
+
+func (b *hungBackend) WithOutput(out, err io.Writer) Backend {
+	return b
+}
+
+func (b *hungBackend) WithContext(ctx context.Context) Backend {
+	return &hungBackend{Backend: b.Backend, ctx: ctx, count: b.count}
+}
+
+func TestRetrierAbortsHungOperation(t *testing.T) {
+	hung := &hungBackend{ctx: context.Background(), count: &opCount{}}
+
+	backend := WithPolicy(hung, Policy{Timeout: 50 * time.Millisecond}, ioutil.Discard)
+	start := time.Now()
+	if _, err := backend.RemoteCommit("url", "main", false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Hung operation doesn't time out. Error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	backend = WithPolicy(hung, Policy{Timeout: time.Minute}, ioutil.Discard).WithContext(ctx)
+	if _, err := backend.RemoteCommit("url", "main", false); !errors.Is(err, context.Canceled) {
+		t.Errorf("Hung operation isn't canceled. Error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Hung operation is waited for %s", elapsed)
+	}
+}
+
+func TestRetrierWaitsForAbortedAttempt(t *testing.T) {
+	hung := &hungBackend{ctx: context.Background(), count: &opCount{}}
+	policy := Policy{Timeout: 30 * time.Millisecond, Retries: 2, Backoff: time.Millisecond}
+	backend := WithPolicy(hung, policy, ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "shelp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err = backend.Clone("url", tmpDir, Option{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Hung clone doesn't time out. Error = %v", err)
+	}
+	if hung.count.running != 0 || hung.count.most != 1 {
+		t.Errorf(
+			"Attempts overlap. running = %d, most at once = %d", hung.count.running, hung.count.most)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{"fatal: unable to access 'https://x/': Could not resolve host: x", true},
+		{"fatal: unable to access 'https://x/': The requested URL returned error: 502", true},
+		{"fatal: unable to access 'https://x/': The requested URL returned error: 404", false},
+		{"remote: Repository not found.\nfatal: repository 'https://x/' not found", false},
+		{"fatal: Remote branch v9 not found in upstream origin", false},
+		{"fatal: couldn't find remote ref refs/heads/v9", false},
+		// Names of repositories or hosts which contain the words are not taken as permanent
+		{"fatal: unable to access 'https://notfound.example/': Connection refused", true},
+		{"error: RPC failed; curl 56 invalid-proxy.example reset", true},
+	}
+	for _, tt := range tests {
+		err := &CommandError{Stderr: tt.stderr, Err: errors.New("exit status 128")}
+		if got := IsRetryable(err); got != tt.want {
+			t.Errorf("IsRetryable(%q) = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
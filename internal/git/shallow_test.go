@@ -0,0 +1,90 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Shallow clone stays shallow on pull, and follows force-pushed branch
+func TestShallowPull(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git command is not found")
+	}
+	tmpDir, err := ioutil.TempDir("", "shelp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	origin := filepath.Join(tmpDir, "origin")
+	git := func(args ...string) string {
+		args = append([]string{"-C", origin, "-c", "user.name=shelp", "-c", "user.email=shelp@example.com"},
+			args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed. Error = %v, Output = %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(content string, args ...string) string {
+		if err := ioutil.WriteFile(filepath.Join(origin, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "file")
+		git(append([]string{"commit", "-q", "-m", content}, args...)...)
+		return git("rev-parse", "HEAD")
+	}
+	if err = os.Mkdir(origin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("symbolic-ref", "HEAD", "refs/heads/main")
+	commit("first")
+	url := "file://" + filepath.ToSlash(origin)
+
+	backends := map[string]Backend{
+		ExecBackend:  NewGit(ioutil.Discard, ioutil.Discard),
+		GoGitBackend: NewGoGit(ioutil.Discard, ioutil.Discard),
+	}
+	for name, backend := range backends {
+		dst := filepath.Join(tmpDir, name)
+		if err := backend.Clone(url, dst, Option{Branch: "main", Shallow: true}); err != nil {
+			t.Fatalf("%s: Clone failed. Error = %v", name, err)
+		}
+
+		for _, step := range []struct {
+			what   string
+			commit func() string
+		}{
+			{"new commit", func() string { return commit(name + " second") }},
+			{"force-push", func() string { return commit(name+" amended", "--amend") }},
+			{"no change", func() string { return git("rev-parse", "HEAD") }},
+		} {
+			want := step.commit()
+			if err := backend.Pull(dst, false); err != nil {
+				t.Errorf("%s: Pull after %s failed. Error = %v", name, step.what, err)
+				continue
+			}
+			if wt, err := backend.Worktree(dst, false); err != nil || wt.Commit != want {
+				t.Errorf("%s: Unexpected commit after %s: %+v. Error = %v", name, step.what, wt, err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dst, ".git", "shallow"))
+			if err != nil {
+				t.Errorf("%s: Repository is not shallow after %s. Error = %v", name, step.what, err)
+				continue
+			}
+			seen := make(map[string]bool)
+			for _, line := range strings.Fields(string(data)) {
+				if seen[line] {
+					t.Errorf("%s: Duplicate shallow commit after %s: %s", name, step.what, line)
+				}
+				seen[line] = true
+			}
+		}
+	}
+}
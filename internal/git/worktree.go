@@ -1,10 +1,13 @@
 package git
 
 type Worktree struct {
-	RemoteURL     string
-	Branch        string
+	RemoteURL string
+	Branch    string
+	// Remote branch tracked by Branch
+	Upstream      string
 	Tag           string
-	defaultBranch string
+	Commit        string
+	DefaultBranch string
 }
 
 func (wt *Worktree) BranchOrTag() string {
@@ -14,6 +17,27 @@ func (wt *Worktree) BranchOrTag() string {
 	return wt.Tag
 }
 
+// UpstreamBranch returns name of remote branch tracked by the local branch. It is assumed to be
+// the same name as the local one unless configured
+func (wt *Worktree) UpstreamBranch() string {
+	if wt.Upstream != "" {
+		return wt.Upstream
+	}
+	return wt.Branch
+}
+
 func (wt *Worktree) IsBranchDefault() bool {
-	return wt.Branch == wt.defaultBranch
+	return wt.Branch == wt.DefaultBranch
+}
+
+// Status is local changes in a working tree
+type Status struct {
+	// Modified or untracked files
+	Changes []string
+	// Number of local commits which are not in remote
+	Unpushed int
+}
+
+func (st *Status) IsClean() bool {
+	return len(st.Changes) == 0 && st.Unpushed == 0
 }
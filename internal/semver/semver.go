@@ -0,0 +1,237 @@
+// Package semver resolves version constraints against tag names of git repositories
+package semver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Latest is the constraint which matches any release version
+const Latest = "latest"
+
+// Version is a semantic version parsed from a tag name
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+	Pre   string
+}
+
+var versionRegexp = regexp.MustCompile(
+	`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z\-\.]+))?(?:\+[0-9A-Za-z\-\.]+)?$`)
+
+// Parse parses a version like "v1.2.3". Minor and patch numbers can be omitted.
+// The second return value tells how many numbers are specified
+func Parse(s string) (Version, int, error) {
+	v := Version{}
+	matched := versionRegexp.FindStringSubmatch(s)
+	if matched == nil {
+		return v, 0, fmt.Errorf("Invalid version: %s", s)
+	}
+
+	parts := 0
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, num := range nums {
+		if matched[i+1] == "" {
+			break
+		}
+		n, err := strconv.Atoi(matched[i+1])
+		if err != nil {
+			return v, 0, fmt.Errorf("Invalid version: %s", s)
+		}
+		*num = n
+		parts++
+	}
+	v.Pre = matched[4]
+	return v, parts, nil
+}
+
+// Compare returns -1, 0 or 1 when v is less than, equal to or greater than o
+func (v Version) Compare(o Version) int {
+	for _, pair := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if pair[0] < pair[1] {
+			return -1
+		}
+		if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case v.Pre < o.Pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// condition is a comparison with a version
+type condition struct {
+	op      string
+	version Version
+}
+
+func (c condition) check(v Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return cmp == 0
+	}
+}
+
+// Constraint is a set of conditions which a version must meet all
+type Constraint struct {
+	source     string
+	conditions []condition
+}
+
+var opRegexp = regexp.MustCompile(`^(\^|~|>=|<=|>|<|=)\s*(.+)$`)
+
+// IsConstraint tells whether the string is a version constraint rather than a git ref
+func IsConstraint(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == Latest || strings.Contains(s, " ") || opRegexp.MatchString(s)
+}
+
+// ParseConstraint parses constraint like "^2.2", "~1.4.0", ">=3 <4" or "latest".
+// Space-separated conditions are combined with AND
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{source: strings.TrimSpace(s)}
+	if c.source == Latest {
+		return c, nil
+	}
+
+	fields := strings.Fields(c.source)
+	if len(fields) == 0 {
+		return c, fmt.Errorf("Empty constraint")
+	}
+	for i := 0; i < len(fields); i++ {
+		term := fields[i]
+		// Allow space between operator and version; e.g. ">= 3"
+		if isOperator(term) && i+1 < len(fields) {
+			i++
+			term += fields[i]
+		}
+		conds, err := parseTerm(term)
+		if err != nil {
+			return c, fmt.Errorf("Invalid constraint: %s", s)
+		}
+		c.conditions = append(c.conditions, conds...)
+	}
+	return c, nil
+}
+
+func isOperator(s string) bool {
+	switch s {
+	case "^", "~", ">=", "<=", ">", "<", "=":
+		return true
+	}
+	return false
+}
+
+func parseTerm(term string) ([]condition, error) {
+	op, ver := "=", term
+	if matched := opRegexp.FindStringSubmatch(term); matched != nil {
+		op, ver = matched[1], matched[2]
+	}
+	v, parts, err := Parse(ver)
+	if err != nil {
+		return nil, err
+	}
+
+	lower := condition{">=", v}
+	switch op {
+	case "^":
+		upper := Version{Major: v.Major + 1}
+		switch {
+		case v.Major == 0 && parts == 1:
+			upper = Version{Major: 1}
+		case v.Major == 0 && v.Minor == 0 && parts == 3:
+			upper = Version{Patch: v.Patch + 1}
+		case v.Major == 0:
+			upper = Version{Minor: v.Minor + 1}
+		}
+		return []condition{lower, {"<", upper}}, nil
+	case "~":
+		upper := Version{Major: v.Major, Minor: v.Minor + 1}
+		if parts == 1 {
+			upper = Version{Major: v.Major + 1}
+		}
+		return []condition{lower, {"<", upper}}, nil
+	case "=":
+		// Partial version matches a range; e.g. "=1.2" means ">=1.2.0 <1.3.0"
+		switch parts {
+		case 1:
+			return []condition{lower, {"<", Version{Major: v.Major + 1}}}, nil
+		case 2:
+			return []condition{lower, {"<", Version{Major: v.Major, Minor: v.Minor + 1}}}, nil
+		}
+		return []condition{{"=", v}}, nil
+	default:
+		return []condition{{op, v}}, nil
+	}
+}
+
+// Check tells whether the version meets the constraint. Pre-release versions are never matched
+func (c Constraint) Check(v Version) bool {
+	if v.Pre != "" {
+		return false
+	}
+	for _, cond := range c.conditions {
+		if !cond.check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckTag tells whether the tag name is a version which meets the constraint
+func (c Constraint) CheckTag(tag string) bool {
+	v, _, err := Parse(tag)
+	return err == nil && c.Check(v)
+}
+
+// Resolve returns the newest tag which meets the constraint. It returns false when no tag matches
+func (c Constraint) Resolve(tags []string) (string, bool) {
+	var (
+		found  string
+		newest Version
+	)
+	for _, tag := range tags {
+		v, _, err := Parse(tag)
+		if err != nil || !c.Check(v) {
+			continue
+		}
+		if found == "" || v.Compare(newest) > 0 {
+			found, newest = tag, v
+		}
+	}
+	return found, found != ""
+}
+
+func (c Constraint) String() string {
+	return c.source
+}
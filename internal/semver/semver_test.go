@@ -0,0 +1,59 @@
+package semver
+
+import "testing"
+
+func TestConstraintResolve(t *testing.T) {
+	tags := []string{
+		"v0.1.0", "v0.1.5", "v0.2.0", "1.3.9", "v1.4.0", "v1.4.2", "v1.5.0", "v2.1.0", "v2.2.0",
+		"v2.2.3", "v2.3.0-rc1", "v2.9.1", "v3.0.0", "v3.5.1", "v4.0.0", "nightly",
+	}
+	tests := []struct {
+		constraint string
+		want       string
+	}{
+		{"latest", "v4.0.0"},
+		{"^2.2", "v2.9.1"},
+		{"^0.1", "v0.1.5"},
+		{"~1.4.0", "v1.4.2"},
+		{"~1", "v1.5.0"},
+		{">=3 <4", "v3.5.1"},
+		{">= 3 < 4", "v3.5.1"},
+		{"=2.2", "v2.2.3"},
+		{"<1", "v0.2.0"},
+		{"^5", ""},
+	}
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("ParseConstraint(%q) failed. Error = %v", tt.constraint, err)
+			continue
+		}
+		got, ok := c.Resolve(tags)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Resolve(%q) = %q, %v; want %q", tt.constraint, got, ok, tt.want)
+		}
+	}
+}
+
+func TestIsConstraint(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"latest", true},
+		{"^2.2", true},
+		{"~1.4.0", true},
+		{">=3 <4", true},
+		{"v2.2.4", false},
+		{"main", false},
+		{"1a2b3c4", false},
+	}
+	for _, tt := range tests {
+		if got := IsConstraint(tt.input); got != tt.want {
+			t.Errorf("IsConstraint(%q) = %v; want %v", tt.input, got, tt.want)
+		}
+	}
+	if _, err := ParseConstraint("^foo"); err == nil {
+		t.Error("ParseConstraint(\"^foo\") must fail")
+	}
+}
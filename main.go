@@ -12,11 +12,15 @@ func main() {
 	cfg := config.NewConfig(os.Stdout, os.Stderr)
 	g := git.NewGit(os.Stdout, os.Stderr)
 	c := cli.NewCli(version, &cfg, g, os.Stdout, os.Stderr)
+	stop := c.HandleSignals()
 	e := c.ParseAndExec(os.Args)
+	stop()
 
 	switch e {
 	case nil, cli.ErrCanceled:
 		// OK
+	case cli.ErrInterrupted:
+		os.Exit(130)
 	default:
 		os.Exit(1)
 	}